@@ -0,0 +1,55 @@
+package abc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Placement describes where an annotation is placed relative to the note.
+type Placement byte
+
+const (
+	PlaceAbove = Placement('^')
+	PlaceBelow = Placement('_')
+	PlaceLeft  = Placement('<')
+	PlaceRight = Placement('>')
+	// PlaceFree uses the offset specified in the annotation.
+	PlaceFree = Placement('@')
+)
+
+// Annotation is a text annotation, e.g. `"^rit."` or `"@10,5 text"`.
+type Annotation struct {
+	Placement Placement
+	// X, Y is the offset for PlaceFree.
+	X, Y float64
+	Text string
+}
+
+// ParseAnnotation parses the contents of a quoted annotation.
+// Annotation without a placement prefix is placed above.
+func ParseAnnotation(s string) Annotation {
+	if s == "" {
+		return Annotation{Placement: PlaceAbove}
+	}
+
+	switch Placement(s[0]) {
+	case PlaceAbove, PlaceBelow, PlaceLeft, PlaceRight:
+		return Annotation{Placement: Placement(s[0]), Text: s[1:]}
+	case PlaceFree:
+		ann := Annotation{Placement: PlaceFree, Text: s[1:]}
+		offset, text, _ := strings.Cut(s[1:], " ")
+		xs, ys, ok := strings.Cut(offset, ",")
+		if !ok {
+			return ann
+		}
+		x, errx := strconv.ParseFloat(xs, 64)
+		y, erry := strconv.ParseFloat(ys, 64)
+		if errx != nil || erry != nil {
+			return ann
+		}
+		ann.X, ann.Y, ann.Text = x, y, text
+		return ann
+	default:
+		return Annotation{Placement: PlaceAbove, Text: s}
+	}
+}
@@ -0,0 +1,147 @@
+package abc
+
+import (
+	"strings"
+)
+
+// Chord is a chord symbol, e.g. `"Am7/G"`.
+type Chord struct {
+	// Root is the root note with an optional accidental, e.g. "A", "Bb", "F#".
+	// Root is empty for "N.C.".
+	Root string
+	// Quality is one of "", "m", "dim" or "aug".
+	Quality string
+	// Extensions contains the added or altered chord tones,
+	// e.g. "7", "maj7", "6", "b9", "#11", "add9", "sus4".
+	Extensions []string
+	// Bass is the bass note of a slash chord.
+	Bass string
+}
+
+// NoChord is the symbol for "N.C.".
+func (chord Chord) NoChord() bool { return chord.Root == "" }
+
+// ParseChord parses a chord symbol, it returns false when s
+// is not a chord symbol.
+func ParseChord(s string) (chord Chord, ok bool) {
+	s = strings.TrimSpace(s)
+	if s == "N.C." || s == "NC" {
+		return Chord{}, true
+	}
+
+	var rest string
+	chord.Root, rest, ok = parseChordNote(s)
+	if !ok {
+		return Chord{}, false
+	}
+
+	if p := strings.LastIndexByte(rest, '/'); p >= 0 {
+		var after string
+		chord.Bass, after, ok = parseChordNote(rest[p+1:])
+		if !ok || after != "" {
+			return Chord{}, false
+		}
+		rest = rest[:p]
+	}
+
+	// quality
+	switch {
+	case strings.HasPrefix(rest, "maj"), strings.HasPrefix(rest, "Maj"):
+		// major seventh or higher, handled with extensions
+	case strings.HasPrefix(rest, "min"):
+		chord.Quality, rest = "m", rest[3:]
+	case strings.HasPrefix(rest, "mi"):
+		chord.Quality, rest = "m", rest[2:]
+	case strings.HasPrefix(rest, "m"), strings.HasPrefix(rest, "-"):
+		chord.Quality, rest = "m", rest[1:]
+	case strings.HasPrefix(rest, "dim"):
+		chord.Quality, rest = "dim", rest[3:]
+	case strings.HasPrefix(rest, "°"):
+		chord.Quality, rest = "dim", rest[len("°"):]
+	case strings.HasPrefix(rest, "o"):
+		chord.Quality, rest = "dim", rest[1:]
+	case strings.HasPrefix(rest, "aug"):
+		chord.Quality, rest = "aug", rest[3:]
+	case strings.HasPrefix(rest, "+"):
+		chord.Quality, rest = "aug", rest[1:]
+	case strings.HasPrefix(rest, "ø"):
+		chord.Quality, rest = "m", rest[len("ø"):]
+		chord.Extensions = append(chord.Extensions, "7", "b5")
+		rest = strings.TrimPrefix(rest, "7")
+	}
+
+	// extensions
+	for rest != "" {
+		switch rest[0] {
+		case '(', ')', ',', ' ':
+			rest = rest[1:]
+			continue
+		}
+
+		prefix := ""
+		for _, p := range []string{"maj", "Maj", "M", "Δ", "add", "sus", "b", "#", "+", "-"} {
+			if strings.HasPrefix(rest, p) {
+				prefix, rest = p, rest[len(p):]
+				break
+			}
+		}
+		digits := 0
+		for digits < len(rest) && '0' <= rest[digits] && rest[digits] <= '9' {
+			digits++
+		}
+		number := rest[:digits]
+		rest = rest[digits:]
+
+		switch prefix {
+		case "maj", "Maj", "M", "Δ":
+			if number == "" {
+				number = "7"
+			}
+			chord.Extensions = append(chord.Extensions, "maj"+number)
+		case "add":
+			if number == "" {
+				return Chord{}, false
+			}
+			chord.Extensions = append(chord.Extensions, "add"+number)
+		case "sus":
+			if number == "" {
+				number = "4"
+			}
+			chord.Extensions = append(chord.Extensions, "sus"+number)
+		case "b", "-":
+			if number == "" {
+				return Chord{}, false
+			}
+			chord.Extensions = append(chord.Extensions, "b"+number)
+		case "#", "+":
+			if number == "" {
+				return Chord{}, false
+			}
+			chord.Extensions = append(chord.Extensions, "#"+number)
+		default:
+			if number == "" {
+				return Chord{}, false
+			}
+			chord.Extensions = append(chord.Extensions, number)
+		}
+	}
+
+	return chord, true
+}
+
+// parseChordNote parses a note name with an optional accidental.
+func parseChordNote(s string) (note, rest string, ok bool) {
+	if s == "" || s[0] < 'A' || s[0] > 'G' {
+		return "", s, false
+	}
+	note, rest = s[:1], s[1:]
+	switch {
+	case strings.HasPrefix(rest, "#"), strings.HasPrefix(rest, "b"):
+		note, rest = note+rest[:1], rest[1:]
+	case strings.HasPrefix(rest, "♯"):
+		note, rest = note+"#", rest[len("♯"):]
+	case strings.HasPrefix(rest, "♭"):
+		note, rest = note+"b", rest[len("♭"):]
+	}
+	return note, rest, true
+}
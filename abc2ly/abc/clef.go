@@ -0,0 +1,165 @@
+package abc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Clef contains the clef and staff modifiers of `K:` and `V:` fields,
+// e.g. `clef=bass middle=d transpose=-2`.
+type Clef struct {
+	// Name is one of treble, bass, alto, tenor, perc or none,
+	// empty when the clef is not specified.
+	Name string
+	// Line is the staff line of the clef counting from the bottom,
+	// 0 means the default line for the clef.
+	Line int
+	// Ottava is 1 for `+8` and -1 for `-8` suffix.
+	Ottava int
+	// Middle is the pitch of the middle staff line, e.g. "d".
+	Middle string
+	// Transpose is the playback transposition in semitones.
+	Transpose int
+	// Octave shifts the octave of the notes.
+	Octave int
+	// StaffLines is the number of staff lines, 0 when not specified.
+	StaffLines int
+
+	// HasTranspose and HasOctave report whether
+	// `transpose=` and `octave=` were specified.
+	HasTranspose bool
+	HasOctave    bool
+}
+
+var rxClefName = regexp.MustCompile(`(?i)^(treble|bass|alto|tenor|perc|none)([1-5])?([+-]8)?$`)
+
+// parseModifier parses a single clef modifier, e.g. `clef=bass` or `middle=d`.
+// ok is false when field is not a clef modifier.
+func (clef *Clef) parseModifier(field string) (ok bool, err error) {
+	name, value, hasValue := strings.Cut(field, "=")
+	if !hasValue {
+		return clef.parseName(field), nil
+	}
+
+	value = strings.Trim(value, `"`)
+	switch strings.ToLower(name) {
+	case "clef":
+		if !clef.parseName(value) {
+			return true, fmt.Errorf("unknown clef %q", value)
+		}
+	case "middle", "m":
+		if !rxNotePitch.MatchString(value) {
+			return true, fmt.Errorf("invalid middle %q", value)
+		}
+		clef.Middle = value
+	case "transpose":
+		clef.Transpose, err = strconv.Atoi(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid transpose %q: %w", value, err)
+		}
+		clef.HasTranspose = true
+	case "octave":
+		clef.Octave, err = strconv.Atoi(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid octave %q: %w", value, err)
+		}
+		clef.HasOctave = true
+	case "stafflines":
+		clef.StaffLines, err = strconv.Atoi(value)
+		if err != nil || clef.StaffLines < 0 {
+			return true, fmt.Errorf("invalid stafflines %q", value)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseName parses clef name with the optional line and octave,
+// e.g. `bass3` or `treble-8`.
+func (clef *Clef) parseName(s string) bool {
+	match := rxClefName.FindStringSubmatch(s)
+	if match == nil {
+		return false
+	}
+	clef.Name = strings.ToLower(match[1])
+	clef.Line, _ = strconv.Atoi(match[2])
+	switch match[3] {
+	case "+8":
+		clef.Ottava = 1
+	case "-8":
+		clef.Ottava = -1
+	default:
+		clef.Ottava = 0
+	}
+	return true
+}
+
+func isClefName(s string) bool { return rxClefName.MatchString(s) }
+
+// With returns clef with the modifiers specified in next applied.
+func (clef Clef) With(next Clef) Clef {
+	if next.Name != "" {
+		clef.Name, clef.Line, clef.Ottava = next.Name, next.Line, next.Ottava
+	}
+	if next.Middle != "" {
+		clef.Middle = next.Middle
+	}
+	if next.HasTranspose {
+		clef.Transpose, clef.HasTranspose = next.Transpose, true
+	}
+	if next.HasOctave {
+		clef.Octave, clef.HasOctave = next.Octave, true
+	}
+	if next.StaffLines != 0 {
+		clef.StaffLines = next.StaffLines
+	}
+	return clef
+}
+
+// Sign returns the clef symbol (G, F or C) and the staff line it is on.
+func (clef Clef) Sign() (sign byte, line int) {
+	switch clef.Name {
+	case "bass":
+		sign, line = 'F', 4
+	case "alto":
+		sign, line = 'C', 3
+	case "tenor":
+		sign, line = 'C', 4
+	default:
+		sign, line = 'G', 2
+	}
+	if clef.Line != 0 {
+		line = clef.Line
+	}
+	return sign, line
+}
+
+// OctaveShift returns how many octaves the notes sound from the written pitch
+// due to `+8`, `-8`, `middle=` and `octave=`.
+func (clef Clef) OctaveShift() (int, error) {
+	shift := clef.Ottava + clef.Octave
+	if clef.Middle == "" {
+		return shift, nil
+	}
+
+	// diatonic steps from middle C
+	sign, line := clef.Sign()
+	signStep := map[byte]int{'G': 4, 'F': 3 - 7, 'C': 0}[sign]
+	defaultMiddle := signStep + 2*(3-line)
+
+	match := rxNotePitch.FindStringSubmatch(clef.Middle)
+	middle := strings.Index("cdefgab", strings.ToLower(match[2]))
+	if match[2] == strings.ToLower(match[2]) {
+		middle += 7
+	}
+	middle += 7 * (strings.Count(match[3], "'") - strings.Count(match[3], ","))
+
+	diff := defaultMiddle - middle
+	if diff%7 != 0 {
+		return shift, fmt.Errorf("unsupported middle=%s for %s clef", clef.Middle, clef.Name)
+	}
+	return shift + diff/7, nil
+}
@@ -0,0 +1,111 @@
+package abc
+
+import "strings"
+
+// decorationShorthands maps the single character decorations to
+// their full names.
+var decorationShorthands = map[string]string{
+	".": "staccato",
+	"~": "roll",
+	"H": "fermata",
+	"L": "accent",
+	"M": "lowermordent",
+	"O": "coda",
+	"P": "uppermordent",
+	"S": "segno",
+	"T": "trill",
+	"u": "upbow",
+	"v": "downbow",
+}
+
+// decorations contains the decorations defined by the ABC 2.1 standard.
+var decorations = map[string]bool{}
+
+func init() {
+	for _, name := range strings.Fields(`
+		trill trill( trill) lowermordent uppermordent mordent pralltriller
+		roll turn turnx invertedturn invertedturnx arpeggio
+		> accent emphasis ^ marcato fermata invertedfermata tenuto staccato
+		0 1 2 3 4 5 + plus snap slide wedge upbow downbow open thumb breath
+		ped ped-up shortphrase mediumphrase longphrase
+		editorial courtesy invisible
+
+		pppp ppp pp p mp mf f ff fff ffff sfz
+		crescendo( <( crescendo) <) diminuendo( >( diminuendo) >)
+
+		segno coda D.S. D.C. dacoda dacapo fine
+		D.C.alcoda D.C.alfine D.S.alcoda D.S.alfine
+	`) {
+		decorations[name] = true
+	}
+}
+
+// DecorationName returns the name of a decoration symbol value,
+// e.g. "trill" for both `T` and `!trill!`.
+func DecorationName(value string) string {
+	if name, ok := decorationShorthands[value]; ok {
+		return name
+	}
+	if len(value) > 2 && (value[0] == '!' || value[0] == '+') {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// IsDecoration reports whether name is a decoration defined by the standard.
+func IsDecoration(name string) bool {
+	return decorations[name]
+}
+
+// HairpinStart returns "<" or ">" when name starts a crescendo or
+// a diminuendo, otherwise it returns "".
+func HairpinStart(name string) string {
+	switch name {
+	case "crescendo(", "<(":
+		return "<"
+	case "diminuendo(", ">(":
+		return ">"
+	}
+	return ""
+}
+
+// IsHairpinEnd reports whether name ends a crescendo or a diminuendo.
+func IsHairpinEnd(name string) bool {
+	switch name {
+	case "crescendo)", "<)", "diminuendo)", ">)":
+		return true
+	}
+	return false
+}
+
+// checkHairpins warns about hairpins in the voice that are not paired.
+func (p *Parser) checkHairpins(voice *Voice) {
+	var open *Symbol
+	for _, stave := range voice.Staves {
+		for i := range stave.Symbols {
+			sym := &stave.Symbols[i]
+			if sym.Kind != KindDeco {
+				continue
+			}
+			name := DecorationName(sym.Value)
+			switch {
+			case HairpinStart(name) != "":
+				open = sym
+			case IsHairpinEnd(name):
+				if open == nil {
+					p.Warnings = append(p.Warnings, Warning{
+						Pos:     sym.Pos,
+						Message: "hairpin end without a start",
+					})
+				}
+				open = nil
+			}
+		}
+	}
+	if open != nil {
+		p.Warnings = append(p.Warnings, Warning{
+			Pos:     open.Pos,
+			Message: "hairpin is never closed",
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package abc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Key is a key signature, e.g. `K:D Mixolydian` or `K:D exp ^f _b`.
+type Key struct {
+	// Tonic is the tonic with an optional accidental, e.g. "D", "F#", "Bb".
+	// Tonic is empty when the key only changes modifiers or for K:none.
+	Tonic string
+	// Mode is one of major, minor, ionian, dorian, phrygian, lydian,
+	// mixolydian, aeolian or locrian.
+	Mode string
+	// None is set for `K:none`, which has no key signature.
+	None bool
+	// Explicit is set for `exp`, where Accidentals replace the key signature.
+	Explicit bool
+	// Accidentals contains added or explicit accidentals, e.g. `^f _b`.
+	Accidentals []Note
+
+	// Clef contains the clef modifiers, e.g. `clef=bass octave=-1`.
+	Clef Clef
+}
+
+var modes = []string{"major", "minor", "ionian", "dorian", "phrygian", "lydian", "mixolydian", "aeolian", "locrian"}
+
+// modeFifths is the position of the mode relative to major in the circle of fifths.
+var modeFifths = map[string]int{
+	"major":      0,
+	"ionian":     0,
+	"lydian":     1,
+	"mixolydian": -1,
+	"dorian":     -2,
+	"minor":      -3,
+	"aeolian":    -3,
+	"phrygian":   -4,
+	"locrian":    -5,
+}
+
+var rxKeyAccidental = regexp.MustCompile(`^(\^\^|__|\^|_|=)([a-gA-G])$`)
+
+// ParseKey parses the value of `K:` field.
+func ParseKey(s string) (Key, error) {
+	var key Key
+	fields := splitFields(s)
+
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		switch first := fields[0]; {
+		case strings.EqualFold(first, "none"):
+			key.None = true
+			fields = fields[1:]
+		case first == "HP":
+			// highland pipes, without a key signature
+			key.Tonic, key.Mode, key.Explicit = "A", "mixolydian", true
+			fields = fields[1:]
+		case isClefName(first):
+			// clef without a key signature, e.g. `K:bass`
+		case first == "Hp":
+			// highland pipes, with f and c sharp and g natural
+			key.Tonic, key.Mode, key.Explicit = "A", "mixolydian", true
+			key.Accidentals = []Note{{Accidentals: "^", Pitch: "f"}, {Accidentals: "^", Pitch: "c"}, {Accidentals: "=", Pitch: "g"}}
+			fields = fields[1:]
+		default:
+			tonic, rest, ok := parseTonic(first)
+			if !ok {
+				break
+			}
+			key.Tonic = tonic
+			fields = fields[1:]
+
+			if rest != "" {
+				key.Mode, ok = parseMode(rest)
+				if !ok {
+					return Key{}, fmt.Errorf("unknown mode %q", rest)
+				}
+			} else if len(fields) > 0 {
+				if mode, ok := parseMode(fields[0]); ok {
+					key.Mode = mode
+					fields = fields[1:]
+				}
+			}
+			if key.Mode == "" {
+				key.Mode = "major"
+			}
+			if n := key.fifths(); n < -7 || n > 7 {
+				return Key{}, fmt.Errorf("key %q has too many accidentals", s)
+			}
+		}
+	}
+
+	for _, field := range fields {
+		if strings.EqualFold(field, "exp") {
+			key.Explicit = true
+			continue
+		}
+		if match := rxKeyAccidental.FindStringSubmatch(field); len(match) > 0 {
+			key.Accidentals = append(key.Accidentals, Note{
+				Accidentals: match[1],
+				Pitch:       strings.ToLower(match[2]),
+			})
+			continue
+		}
+
+		ok, err := key.Clef.parseModifier(field)
+		if err != nil {
+			return Key{}, err
+		}
+		if !ok {
+			return Key{}, fmt.Errorf("unknown key field %q", field)
+		}
+	}
+
+	return key, nil
+}
+
+// parseTonic parses the tonic at the start of s.
+func parseTonic(s string) (tonic, rest string, ok bool) {
+	if s == "" || !strings.ContainsRune("ABCDEFG", rune(s[0])) {
+		return "", s, false
+	}
+	tonic, rest = s[:1], s[1:]
+	if strings.HasPrefix(rest, "#") || strings.HasPrefix(rest, "b") {
+		tonic, rest = tonic+rest[:1], rest[1:]
+	}
+	return tonic, rest, true
+}
+
+// parseMode parses full or abbreviated mode name.
+func parseMode(s string) (string, bool) {
+	s = strings.ToLower(s)
+	if s == "m" {
+		return "minor", true
+	}
+	if len(s) < 3 {
+		return "", false
+	}
+	for _, mode := range modes {
+		if strings.HasPrefix(mode, s[:3]) && strings.HasPrefix(mode, s) {
+			return mode, true
+		}
+	}
+	return "", false
+}
+
+// HasSignature returns whether the key defines a key signature, as opposed
+// to only changing the clef.
+func (key Key) HasSignature() bool { return key.None || key.Tonic != "" }
+
+// fifths returns the number of sharps (positive) or flats (negative) in the key.
+func (key Key) fifths() int {
+	if key.Tonic == "" {
+		return 0
+	}
+	n := strings.IndexByte("FCGDAEB", key.Tonic[0]) - 1
+	switch key.Tonic[1:] {
+	case "#":
+		n += 7
+	case "b":
+		n -= 7
+	}
+	return n + modeFifths[key.Mode]
+}
+
+// AccidentalMap returns the alteration for every pitch in the key signature,
+// 1 for sharp, -1 for flat and 0 for natural.
+func (key Key) AccidentalMap() map[string]int {
+	acc := map[string]int{}
+	if !key.None && !key.Explicit {
+		if n := key.fifths(); n >= 0 {
+			for _, pitch := range "fcgdaeb"[:n] {
+				acc[string(pitch)] = 1
+			}
+		} else {
+			for _, pitch := range "beadgcf"[:-n] {
+				acc[string(pitch)] = -1
+			}
+		}
+	}
+	for _, note := range key.Accidentals {
+		acc[note.Pitch] = note.Alteration()
+	}
+	return acc
+}
+
+// Alteration returns the alteration specified by the note accidentals.
+func (n Note) Alteration() int {
+	alteration := 0
+	for _, acc := range n.Accidentals {
+		switch acc {
+		case AccidentalFlat:
+			alteration--
+		case AccidentalSharp:
+			alteration++
+		case AccidentalNatural:
+			alteration = 0
+		}
+	}
+	return alteration
+}
@@ -0,0 +1,101 @@
+package abc
+
+import "strings"
+
+// Syllable is a single syllable of aligned lyrics (`w:`).
+// Syllable with an empty Text leaves the note without lyrics.
+type Syllable struct {
+	Text string
+	// Hyphen is set when the syllable continues with a hyphen.
+	Hyphen bool
+	// Extend is set when the syllable is held over the following notes.
+	Extend bool
+}
+
+// AlignLyrics aligns `w:` words to the notes in stave.
+// The result contains a syllable for every note, rests and grace notes
+// are skipped.
+func AlignLyrics(stave *Stave, words string) []Syllable {
+	var notes []int
+	for i, sym := range stave.Symbols {
+		if sym.Kind == KindNote {
+			notes = append(notes, i)
+		}
+	}
+
+	syllables := make([]Syllable, len(notes))
+
+	// cursor is the symbol index where the next syllable can be placed
+	cursor := 0
+	next := 0
+	lastText := -1
+
+	place := func(syl Syllable) {
+		for next < len(notes) && notes[next] < cursor {
+			next++
+		}
+		if next >= len(notes) {
+			return
+		}
+		syllables[next] = syl
+		if syl.Text != "" {
+			lastText = next
+		}
+		cursor = notes[next] + 1
+		next++
+	}
+
+	var text strings.Builder
+	flush := func(hyphen bool) bool {
+		if text.Len() == 0 {
+			return false
+		}
+		place(Syllable{Text: text.String(), Hyphen: hyphen})
+		text.Reset()
+		return true
+	}
+
+	for i := 0; i < len(words); i++ {
+		switch words[i] {
+		case ' ', '\t':
+			flush(false)
+		case '-':
+			if !flush(true) {
+				// hyphen preceded by a space or hyphen is a syllable of its own
+				if lastText >= 0 {
+					syllables[lastText].Hyphen = true
+				}
+				place(Syllable{Hyphen: true})
+			}
+		case '_':
+			flush(false)
+			if lastText >= 0 {
+				syllables[lastText].Extend = true
+			}
+			place(Syllable{})
+		case '*':
+			flush(false)
+			place(Syllable{})
+		case '~':
+			text.WriteByte(' ')
+		case '\\':
+			if i+1 < len(words) && words[i+1] == '-' {
+				text.WriteByte('-')
+				i++
+			} else {
+				text.WriteByte('\\')
+			}
+		case '|':
+			flush(false)
+			for cursor < len(stave.Symbols) && stave.Symbols[cursor].Kind != KindBar {
+				cursor++
+			}
+			cursor++
+		default:
+			text.WriteByte(words[i])
+		}
+	}
+	flush(false)
+
+	return syllables
+}
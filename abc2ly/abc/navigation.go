@@ -0,0 +1,272 @@
+package abc
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Navigation contains the navigation marks of a voice.
+type Navigation struct {
+	// Segnos contains the `!segno!` decorations.
+	Segnos []SymbolRef
+	// ToCodas contains the places where the music continues at the coda,
+	// that is `!dacoda!` and every `!coda!` except the last one.
+	ToCodas []SymbolRef
+	// Coda is the last `!coda!`, which starts the coda.
+	Coda *SymbolRef
+	// Fines contains the `!fine!` decorations.
+	Fines []SymbolRef
+	// Jumps contains the `!D.C.!` and `!D.S.!` decorations.
+	Jumps []Jump
+}
+
+// Jump is a `!D.C.!` or `!D.S.!` decoration, e.g. `!D.S.alcoda!`.
+type Jump struct {
+	// Ref is the jump decoration, the jump is taken at the next bar.
+	Ref SymbolRef
+	// Target is the `!segno!` for D.S. and the start of the voice,
+	// with Symbol -1, for D.C.
+	Target SymbolRef
+	// Until is "fine" when the music after the jump ends at `!fine!`
+	// and "coda" when it continues at the coda. A plain `!D.C.!` or
+	// `!D.S.!` continues to the fine or the coda when the voice has one.
+	Until string
+}
+
+// NavigationError is a jump that has no place to go.
+type NavigationError struct {
+	Pos
+	Err error
+}
+
+func (err *NavigationError) Error() string { return err.Pos.String() + ": " + err.Err.Error() }
+
+func (err *NavigationError) Unwrap() error { return err.Err }
+
+// AnalyzeNavigation finds the navigation marks of the voice.
+// It returns a *NavigationError when a jump has no place to go.
+func AnalyzeNavigation(voice *Voice) (Navigation, error) {
+	var nav Navigation
+
+	var codas []SymbolRef
+	for stavei, stave := range voice.Staves {
+		for symi, sym := range stave.Symbols {
+			if sym.Kind != KindDeco {
+				continue
+			}
+			ref := SymbolRef{Stave: stavei, Symbol: symi}
+			switch name := DecorationName(sym.Value); name {
+			case "segno":
+				nav.Segnos = append(nav.Segnos, ref)
+			case "coda":
+				codas = append(codas, ref)
+			case "dacoda":
+				nav.ToCodas = append(nav.ToCodas, ref)
+			case "fine":
+				nav.Fines = append(nav.Fines, ref)
+			case "D.C.", "dacapo", "D.C.alfine", "D.C.alcoda":
+				nav.Jumps = append(nav.Jumps, Jump{
+					Ref:    ref,
+					Target: SymbolRef{Stave: 0, Symbol: -1},
+					Until:  jumpUntil(name),
+				})
+			case "D.S.", "D.S.alfine", "D.S.alcoda":
+				target, ok := lastBefore(nav.Segnos, ref)
+				if !ok {
+					return nav, &NavigationError{Pos: sym.Pos, Err: errors.New(name + " without a segno")}
+				}
+				nav.Jumps = append(nav.Jumps, Jump{
+					Ref:    ref,
+					Target: target,
+					Until:  jumpUntil(name),
+				})
+			}
+		}
+	}
+
+	if n := len(codas); n > 0 {
+		nav.Coda = &codas[n-1]
+		nav.ToCodas = append(nav.ToCodas, codas[:n-1]...)
+		slices.SortFunc(nav.ToCodas, SymbolRef.Before)
+	}
+
+	for i := range nav.Jumps {
+		jump := &nav.Jumps[i]
+		pos := voice.Staves[jump.Ref.Stave].Symbols[jump.Ref.Symbol].Pos
+		switch jump.Until {
+		case "":
+			if len(nav.Fines) > 0 {
+				jump.Until = "fine"
+			} else if nav.Coda != nil && len(nav.ToCodas) > 0 {
+				jump.Until = "coda"
+			}
+		case "fine":
+			if len(nav.Fines) == 0 {
+				return nav, &NavigationError{Pos: pos, Err: errors.New("jump al fine without a fine")}
+			}
+		case "coda":
+			if nav.Coda == nil || len(nav.ToCodas) == 0 {
+				return nav, &NavigationError{Pos: pos, Err: errors.New("jump al coda without a coda")}
+			}
+		}
+	}
+
+	return nav, nil
+}
+
+// jumpUntil returns where the music after the named jump ends.
+func jumpUntil(name string) string {
+	switch {
+	case strings.HasSuffix(name, "alfine"):
+		return "fine"
+	case strings.HasSuffix(name, "alcoda"):
+		return "coda"
+	}
+	return ""
+}
+
+// Before returns whether ref comes before other in the voice.
+func (ref SymbolRef) Before(other SymbolRef) bool {
+	if ref.Stave != other.Stave {
+		return ref.Stave < other.Stave
+	}
+	return ref.Symbol < other.Symbol
+}
+
+// lastBefore returns the last ref that comes before end.
+func lastBefore(refs []SymbolRef, end SymbolRef) (SymbolRef, bool) {
+	for i := len(refs) - 1; i >= 0; i-- {
+		if refs[i].Before(end) {
+			return refs[i], true
+		}
+	}
+	return SymbolRef{}, false
+}
+
+// firstAfter returns the first ref that comes after start.
+func firstAfter(refs []SymbolRef, start SymbolRef) (SymbolRef, bool) {
+	for _, ref := range refs {
+		if start.Before(ref) {
+			return ref, true
+		}
+	}
+	return SymbolRef{}, false
+}
+
+// NextBar returns the first bar after ref. It returns the end of the
+// voice, with Stave as the number of staves, when there are no bars.
+func (voice *Voice) NextBar(ref SymbolRef) SymbolRef {
+	for stavei := ref.Stave; stavei < len(voice.Staves); stavei++ {
+		symbols := voice.Staves[stavei].Symbols
+		symi := 0
+		if stavei == ref.Stave {
+			symi = ref.Symbol + 1
+		}
+		for ; symi < len(symbols); symi++ {
+			if symbols[symi].Kind == KindBar {
+				return SymbolRef{Stave: stavei, Symbol: symi}
+			}
+		}
+	}
+	return SymbolRef{Stave: len(voice.Staves)}
+}
+
+// UnfoldJumps returns a copy of the tune where the music of every voice
+// is rearranged in the playing order of the D.C. and D.S. jumps.
+// Only the first jump of a voice is taken and repeat bars are kept as is.
+func (tune *Tune) UnfoldJumps() (*Tune, error) {
+	unfolded := *tune
+	unfolded.Body.Voices = nil
+	for _, voice := range tune.Body.Voices {
+		v, err := voice.unfoldJumps()
+		if err != nil {
+			return nil, err
+		}
+		unfolded.Body.Voices = append(unfolded.Body.Voices, v)
+	}
+	return &unfolded, nil
+}
+
+// unfoldJumps rearranges the staves of the voice in the playing order.
+func (voice *Voice) unfoldJumps() (*Voice, error) {
+	nav, err := AnalyzeNavigation(voice)
+	if err != nil {
+		return nil, err
+	}
+	if len(nav.Jumps) == 0 {
+		return voice, nil
+	}
+	jump := nav.Jumps[0]
+	end := SymbolRef{Stave: len(voice.Staves)}
+
+	v := *voice
+	v.Staves = nil
+	add := func(from, to SymbolRef) {
+		v.Staves = append(v.Staves, voice.slice(from, to)...)
+	}
+
+	add(SymbolRef{}, voice.afterBar(jump.Ref))
+	switch jump.Until {
+	case "fine":
+		fine, ok := firstAfter(nav.Fines, jump.Target)
+		if !ok {
+			return nil, errors.New("no fine after the jump target")
+		}
+		add(jump.Target, voice.afterBar(fine))
+	case "coda":
+		toCoda, ok := firstAfter(nav.ToCodas, jump.Target)
+		if !ok {
+			return nil, errors.New("no coda after the jump target")
+		}
+		add(jump.Target, voice.afterBar(toCoda))
+		add(*nav.Coda, end)
+	default:
+		add(jump.Target, end)
+	}
+	return &v, nil
+}
+
+// afterBar returns the position after the first bar that follows ref.
+func (voice *Voice) afterBar(ref SymbolRef) SymbolRef {
+	bar := voice.NextBar(ref)
+	if bar.Stave < len(voice.Staves) {
+		bar.Symbol++
+	}
+	return bar
+}
+
+// slice returns the staves between from and to, excluding to.
+func (voice *Voice) slice(from, to SymbolRef) []Stave {
+	var staves []Stave
+	for stavei := from.Stave; stavei <= to.Stave && stavei < len(voice.Staves); stavei++ {
+		stave := voice.Staves[stavei]
+		lo, hi := 0, len(stave.Symbols)
+		if stavei == from.Stave && from.Symbol > 0 {
+			lo = from.Symbol
+		}
+		if stavei == to.Stave {
+			hi = to.Symbol
+		}
+		if lo >= hi {
+			continue
+		}
+
+		_, tail := splitStave(stave, lo, countNotes(stave.Symbols[:lo]))
+		head, _ := splitStave(tail, hi-lo, countNotes(tail.Symbols[:hi-lo]))
+		staves = append(staves, head)
+	}
+	return staves
+}
+
+// countNotes returns the number of notes in symbols.
+func countNotes(symbols []Symbol) int {
+	notes := 0
+	for _, sym := range symbols {
+		if sym.Kind == KindNote {
+			notes++
+		}
+	}
+	return notes
+}
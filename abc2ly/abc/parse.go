@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var rxHeader = regexp.MustCompile(`^([a-zA-Z]):(.*)$`)
@@ -15,9 +16,20 @@ var rxNewTune = regexp.MustCompile(`(?m)^X:`) // TODO: avoid regex
 type Parser struct {
 	Book  *TuneBook
 	Tune  *Tune
+	Voice *Voice
 	Stave *Stave
+	Grace *Grace
 
 	Warnings []Warning
+
+	// timing is the meter and unit note length in the tune body.
+	timing Timing
+	// broken is the broken rhythm waiting for the next note.
+	broken int
+
+	// lineNumber and lineText are the current line in the tunebook.
+	lineNumber int
+	lineText   string
 }
 
 func NewParser() *Parser {
@@ -27,8 +39,21 @@ func NewParser() *Parser {
 }
 
 type Warning struct {
+	Pos
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Pos.String() + ": " + w.Message
+}
+
+// Pos is a 1-based line and column in the tunebook.
+type Pos struct {
 	Line, Column int
-	Message      string
+}
+
+func (pos Pos) String() string {
+	return strconv.Itoa(pos.Line) + ":" + strconv.Itoa(pos.Column)
 }
 
 func Parse(content string) (*TuneBook, []Warning) {
@@ -39,35 +64,155 @@ func Parse(content string) (*TuneBook, []Warning) {
 
 func SplitTuneBook(s string) []string {
 	var tunes []string
+	for _, tune := range splitTuneBook(s) {
+		tunes = append(tunes, tune.content)
+	}
+	return tunes
+}
+
+type tuneSource struct {
+	content string
+	line    int
+}
+
+func splitTuneBook(s string) []tuneSource {
+	var tunes []tuneSource
+
+	add := func(start, end int) {
+		chunk := s[start:end]
+		tune := strings.TrimSpace(chunk)
+		if tune == "" {
+			return
+		}
+		leading := len(chunk) - len(strings.TrimLeft(chunk, " \t\r\n"))
+		tunes = append(tunes, tuneSource{
+			content: tune,
+			line:    1 + strings.Count(s[:start+leading], "\n"),
+		})
+	}
 
 	start := 0
 	for _, loc := range rxNewTune.FindAllStringIndex(s, -1) {
-		if tune := strings.TrimSpace(s[start:loc[0]]); tune != "" {
-			tunes = append(tunes, tune)
-		}
+		add(start, loc[0])
 		start = loc[0]
 	}
-	if tune := strings.TrimSpace(s[start:]); tune != "" {
-		tunes = append(tunes, tune)
-	}
+	add(start, len(s))
 
 	return tunes
 }
 
 func (p *Parser) ParseBook(content string) {
-	for _, tune := range SplitTuneBook(content) {
-		p.ParseTune(tune)
+	for i, tune := range splitTuneBook(content) {
+		if i == 0 && isFileHeader(tune.content) {
+			p.parseHeader(tune.content, tune.line)
+			continue
+		}
+		p.parseTune(tune.content, tune.line)
+	}
+}
+
+// isFileHeader checks whether the section before the first tune is a file header.
+func isFileHeader(content string) bool {
+	if strings.HasPrefix(content, "X:") {
+		return false
+	}
+	// tune without `X:`
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "K:") {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeader parses the file header, which ends with an empty line.
+func (p *Parser) parseHeader(content string, firstLine int) {
+	for i, line := range strings.Split(content, "\n") {
+		p.lineNumber, p.lineText = firstLine+i, line
+		if strings.TrimSpace(line) == "" {
+			// rest of the section is free text
+			break
+		}
+
+		// `%%directive` is equivalent to `I:directive`
+		if strings.HasPrefix(line, "%%") {
+			p.Book.Header = append(p.Book.Header, Field{
+				Pos:   p.pos(line),
+				Tag:   FieldInstruction.Tag,
+				Value: strings.TrimSpace(line[2:]),
+			})
+			continue
+		}
+
+		line = trimTrailingWhitespace(trimComment(line))
+		p.lineText = line
+		if line == "" {
+			continue
+		}
+
+		match := rxHeader.FindStringSubmatch(line)
+		if len(match) == 0 {
+			p.warnf(line, "unable to parse %q", line)
+			continue
+		}
+
+		value := strings.TrimSpace(match[2])
+		switch match[1] {
+		case FieldMeter.Tag:
+			if _, err := ParseMeter(value); err != nil {
+				p.warnf(line, "%v", err)
+				continue
+			}
+		case FieldUnitNoteLength.Tag:
+			if _, err := ParseNoteLength(value); err != nil {
+				p.warnf(line, "%v", err)
+				continue
+			}
+		case FieldTempo.Tag:
+			if _, err := ParseTempo(value); err != nil {
+				p.warnf(line, "%v", err)
+				continue
+			}
+		}
+
+		p.Book.Header = append(p.Book.Header, Field{
+			Pos:   p.pos(line),
+			Tag:   match[1],
+			Value: value,
+		})
 	}
 }
 
 func (p *Parser) ParseTune(content string) {
-	p.Tune = &Tune{Raw: content}
+	p.parseTune(content, 1)
+}
+
+// parseTune parses a tune starting at the specified line in the tunebook.
+func (p *Parser) parseTune(content string, firstLine int) {
+	p.Tune = &Tune{
+		Pos:    Pos{Line: firstLine, Column: 1},
+		Header: p.Book.Header,
+		Raw:    content,
+	}
+	if f, ok := p.Book.Header.ByTag(FieldMeter.Tag); ok {
+		p.Tune.Meter, _ = ParseMeter(f.Value)
+	}
+	p.Voice, p.Stave, p.Grace = nil, nil, nil
+	p.timing = NewTiming(p.Tune.Meter)
+	p.broken = 0
+
+	defer func() {
+		p.danglingGrace()
+		p.Stave = nil
+		p.Book.Tunes = append(p.Book.Tunes, p.Tune)
+	}()
 
 	inheader := true
 
-	for _, line := range strings.Split(content, "\n") {
+	for i, line := range strings.Split(content, "\n") {
 		line = trimComment(line)
 		line = trimTrailingWhitespace(line)
+		p.lineNumber, p.lineText = firstLine+i, line
 		if line == "" {
 			continue
 		}
@@ -85,13 +230,44 @@ func (p *Parser) ParseTune(content string) {
 				case "T":
 					p.Tune.Title = value
 				case "M":
-					p.Tune.Meter = ParseMeter(value)
+					meter, err := ParseMeter(value)
+					if err != nil {
+						p.fail(line, err)
+						break
+					}
+					p.Tune.Meter = meter
+				case "L":
+					if _, err := ParseNoteLength(value); err != nil {
+						p.fail(line, err)
+					}
 				case "K":
-					p.Tune.Key = value
+					p.timing, _ = p.Tune.Timing()
+					key, err := ParseKey(value)
+					if err != nil {
+						p.fail(line, err)
+					}
+					p.Tune.Key = key
 					inheader = false
+				case "P":
+					parts, err := ParsePartOrder(value)
+					if err != nil {
+						p.warnf(line, "%v", err)
+						continue
+					}
+					p.Tune.Parts = parts
+				case "Q":
+					if _, err := ParseTempo(value); err != nil {
+						p.warnf(line, "%v", err)
+						continue
+					}
+				case "V":
+					if _, err := p.Tune.Body.DefineVoice(value); err != nil {
+						p.warnf(line, "%v", err)
+					}
 				}
 
 				p.Tune.Fields = append(p.Tune.Fields, Field{
+					Pos:   p.pos(line),
 					Tag:   match[1],
 					Value: value,
 				})
@@ -102,42 +278,200 @@ func (p *Parser) ParseTune(content string) {
 			inheader = false
 		}
 
-		p.Stave = &Stave{}
+		if p.Stave == nil {
+			p.Stave = &Stave{}
+		}
+
+		if match := rxHeader.FindStringSubmatch(line); len(match) > 0 {
+			p.ParseBodyField(match[1], strings.TrimSpace(match[2]))
+			continue
+		}
+
 		prevLine := ""
 		for prevLine != line {
 			prevLine = line
 
 			line = p.TryParseField(line)
+			line = p.TryParseTuplet(line)
+			line = p.TryParseSlur(line)
 			line = p.TryParseDeco(line)
+			line = p.TryParseGrace(line)
 			line = p.TryParseNote(line)
 			line = p.TryParseText(line)
 			line = p.TryParseBar(line)
 
 			// TODO: handle note groups
-			// TODO: handle tuplets
-			// TODO: handle slurs
 
 			line = strings.TrimLeft(line, " \t")
 		}
-		if len(p.Stave.Symbols) > 0 {
-			p.Tune.Body.Staves = append(p.Tune.Body.Staves, *p.Stave)
-		}
-		p.Stave = nil
+		// broken rhythm does not continue on the next line
+		p.danglingBroken(line)
+		p.flushStave()
 		if line != "" {
-			p.Warnings = append(p.Warnings, Warning{
-				Message: fmt.Sprintf("unable to parse %q", line),
-			})
+			p.warnf(line, "unable to parse %q", line)
+		}
+	}
+
+	// fields after the last music line
+	if p.Stave != nil && len(p.Stave.Symbols) > 0 {
+		voice := p.currentVoice()
+		if n := len(voice.Staves); n > 0 {
+			voice.Staves[n-1].Symbols = append(voice.Staves[n-1].Symbols, p.Stave.Symbols...)
+		} else {
+			voice.Staves = append(voice.Staves, *p.Stave)
+		}
+	}
+
+	for _, voice := range p.Tune.Body.Voices {
+		p.checkHairpins(voice)
+	}
+}
+
+// ParseBodyField handles a field on its own line in the tune body.
+func (p *Parser) ParseBodyField(tag, value string) {
+	switch tag {
+	case FieldVoice.Tag:
+		p.switchVoice(p.lineText, value)
+	case FieldWords2.Tag:
+		voice := p.currentVoice()
+		if len(voice.Staves) == 0 {
+			p.warnf(p.lineText, "no music for words %q", value)
+			return
+		}
+		stave := &voice.Staves[len(voice.Staves)-1]
+		stave.Lyrics = append(stave.Lyrics, AlignLyrics(stave, value))
+	default:
+		if !p.checkField(p.lineText, tag, value) {
+			return
+		}
+		// the field applies to the following music line
+		p.add(p.lineText, Symbol{
+			Kind:  KindField,
+			Tag:   tag,
+			Value: value,
+		})
+	}
+}
+
+// pos returns the position of rest in the current line.
+func (p *Parser) pos(rest string) Pos {
+	offset := len(p.lineText) - len(rest)
+	if offset < 0 || offset > len(p.lineText) {
+		offset = 0
+	}
+	return Pos{
+		Line:   p.lineNumber,
+		Column: 1 + utf8.RuneCountInString(p.lineText[:offset]),
+	}
+}
+
+// add adds symbol to the current stave, rest is the unparsed part
+// of the line starting with the symbol.
+func (p *Parser) add(rest string, sym Symbol) {
+	sym.Pos = p.pos(rest)
+	p.Stave.Symbols = append(p.Stave.Symbols, sym)
+}
+
+// warnf adds a warning at the start of rest.
+func (p *Parser) warnf(rest string, format string, args ...any) {
+	p.Warnings = append(p.Warnings, Warning{
+		Pos:     p.pos(rest),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// fail marks the current tune as failed.
+func (p *Parser) fail(rest string, err error) {
+	p.Tune.Failed = true
+	p.warnf(rest, "tune %q: %v", p.Tune.ID, err)
+}
+
+// checkField validates inline fields that are needed to interpret the music
+// and keeps track of the timing.
+func (p *Parser) checkField(rest, tag, value string) bool {
+	var err error
+	switch tag {
+	case FieldMeter.Tag:
+		var meter Meter
+		if meter, err = ParseMeter(value); err == nil {
+			p.timing.SetMeter(meter)
+		}
+	case FieldUnitNoteLength.Tag:
+		var length big.Rat
+		if length, err = ParseNoteLength(value); err == nil {
+			p.timing.SetUnitNoteLength(length)
 		}
+	case FieldKey.Tag:
+		_, err = ParseKey(value)
+	case FieldTempo.Tag:
+		_, err = ParseTempo(value)
+	}
+	if err != nil {
+		p.warnf(rest, "%v", err)
+		return false
+	}
+	return true
+}
+
+// currentVoice returns the voice that music is currently added to.
+func (p *Parser) currentVoice() *Voice {
+	if p.Voice == nil {
+		if len(p.Tune.Body.Voices) > 0 {
+			p.Voice = p.Tune.Body.Voices[0]
+		} else {
+			p.Voice, _ = p.Tune.Body.DefineVoice("")
+		}
+	}
+	return p.Voice
+}
+
+// switchVoice starts adding music to the voice defined by `V:` value.
+func (p *Parser) switchVoice(rest, value string) {
+	p.danglingBroken(rest)
+	p.danglingGrace()
+	p.flushStave()
+
+	var err error
+	p.Voice, err = p.Tune.Body.DefineVoice(value)
+	if err != nil {
+		p.warnf(rest, "%v", err)
 	}
+	p.Stave = &Stave{}
 
-	p.Book.Tunes = append(p.Book.Tunes, p.Tune)
+	// clef change after the voice has started applies from this point
+	if clef, err := ParseVoiceClef(value); err == nil && clef != (Clef{}) && len(p.Voice.Staves) > 0 {
+		p.add(rest, Symbol{
+			Kind:  KindField,
+			Tag:   FieldVoice.Tag,
+			Value: value,
+		})
+	}
+}
+
+// flushStave adds the current stave to the current voice.
+func (p *Parser) flushStave() {
+	if p.Stave == nil || !p.Stave.hasMusic() {
+		return
+	}
+	voice := p.currentVoice()
+	voice.Staves = append(voice.Staves, *p.Stave)
+	p.Stave = &Stave{}
 }
 
 var rxInlineField = regexp.MustCompile(`^\[([a-zA-Z]):([^\]]*)\]`)
 
 func (p *Parser) TryParseField(line string) string {
 	if match := rxInlineField.FindStringSubmatch(line); len(match) > 0 {
-		p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
+		if match[1] == FieldVoice.Tag {
+			p.switchVoice(line, strings.TrimSpace(match[2]))
+			return strings.TrimLeft(line[len(match[0]):], " ")
+		}
+		p.danglingBroken(line)
+		if !p.checkField(line, match[1], strings.TrimSpace(match[2])) {
+			return strings.TrimLeft(line[len(match[0]):], " ")
+		}
+
+		p.add(line, Symbol{
 			Kind:  KindField,
 			Tag:   match[1],
 			Value: strings.TrimSpace(match[2]),
@@ -148,11 +482,64 @@ func (p *Parser) TryParseField(line string) string {
 	return line
 }
 
-var rxDeco = regexp.MustCompile(`^([\.~HLMOPSTuv]|![^!]+!)`)
+// `(3`, `(3:2`, `(3:2:4`, `(3::4`
+var rxTuplet = regexp.MustCompile(`^\(([1-9][0-9]*)(?::([0-9]*)(?::([0-9]*))?)?`)
+
+func (p *Parser) TryParseTuplet(line string) string {
+	if match := rxTuplet.FindStringSubmatch(line); len(match) > 0 {
+		tuplet := Tuplet{}
+		tuplet.P, _ = strconv.Atoi(match[1])
+		if match[2] != "" {
+			tuplet.Q, _ = strconv.Atoi(match[2])
+		}
+		if match[3] != "" {
+			tuplet.R, _ = strconv.Atoi(match[3])
+		}
+		tuplet = tuplet.WithDefaults(p.timing.Meter)
+
+		p.add(line, Symbol{
+			Kind:   KindTuplet,
+			Value:  match[0],
+			Tuplet: tuplet,
+		})
+		return strings.TrimLeft(line[len(match[0]):], " ")
+	}
+
+	return line
+}
+
+// `(`, `.(` or `)`
+var rxSlur = regexp.MustCompile(`^(\.?\(|\))`)
+
+func (p *Parser) TryParseSlur(line string) string {
+	if match := rxSlur.FindStringSubmatch(line); len(match) > 0 {
+		kind := KindSlurStart
+		if match[1] == ")" {
+			kind = KindSlurEnd
+		}
+		p.add(line, Symbol{
+			Kind:   kind,
+			Value:  match[1],
+			Dotted: match[1] == ".(",
+		})
+		return strings.TrimLeft(line[len(match[0]):], " ")
+	}
+
+	return line
+}
+
+var rxDeco = regexp.MustCompile(`^([\.~HLMOPSTuv]|![^!]+!|\+[^+]+\+)`)
 
 func (p *Parser) TryParseDeco(line string) string {
+	if strings.HasPrefix(line, ".(") {
+		// dotted slur
+		return line
+	}
 	if match := rxDeco.FindStringSubmatch(line); len(match) > 0 {
-		p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
+		if name := DecorationName(match[1]); !IsDecoration(name) {
+			p.warnf(line, "unknown decoration %q", name)
+		}
+		p.add(line, Symbol{
 			Kind:  KindDeco,
 			Value: strings.TrimSpace(match[1]),
 		})
@@ -162,32 +549,150 @@ func (p *Parser) TryParseDeco(line string) string {
 	return line
 }
 
+// `{g}`, `{/g}`, `{gag}`
+var rxGrace = regexp.MustCompile(`^\{(/?)([^}]*)\}`)
+
+func (p *Parser) TryParseGrace(line string) string {
+	if match := rxGrace.FindStringSubmatch(line); len(match) > 0 {
+		grace := &Grace{
+			Acciaccatura: match[1] != "",
+		}
+
+		grace.Pos = p.pos(line)
+
+		// notes starts after `{` or `{/`
+		notes := strings.TrimLeft(line[1+len(match[1]):], " ")
+		for !strings.HasPrefix(notes, "}") {
+			sym, n, err := ParseNote(notes)
+			if n == 0 || err != nil || sym.Kind != KindNote {
+				return line
+			}
+			sym.Pos = p.pos(notes)
+			grace.Notes = append(grace.Notes, sym)
+			notes = strings.TrimLeft(notes[n:], " ")
+		}
+		if len(grace.Notes) == 0 {
+			return line
+		}
+
+		p.danglingGrace()
+		p.Grace = grace
+		return strings.TrimLeft(line[len(match[0]):], " ")
+	}
+
+	return line
+}
+
+// danglingGrace warns about pending grace notes that are not followed by a note.
+func (p *Parser) danglingGrace() {
+	if p.Grace == nil {
+		return
+	}
+	p.Warnings = append(p.Warnings, Warning{
+		Pos:     p.Grace.Pos,
+		Message: "grace notes without a following note",
+	})
+	p.Grace = nil
+}
+
 var rxNote = regexp.MustCompile(`^([\_\^=]*[a-gA-G][,']*|\[(?:[\_\^=]*[a-gA-G][,']*)+\]|[yzZxX])([0-9]*)(\/*)([0-9]*)([<>]*)(\-?)`)
 var rxNotePitch = regexp.MustCompile(`([\_\^=]*)([a-gA-G])([,']*)`)
 
 func (p *Parser) TryParseNote(line string) string {
-	if match := rxNote.FindStringSubmatch(line); len(match) > 0 {
+	if sym, n, err := ParseNote(line); n > 0 {
+		if err != nil {
+			p.warnf(line, "%v", err)
+			return strings.TrimLeft(line[n:], " ")
+		}
+		if sym.Kind != KindNote {
+			p.danglingGrace()
+		} else if p.Grace != nil {
+			sym.Grace = p.Grace
+			p.Grace = nil
+		}
+		p.resolveBroken(line, &sym)
+		p.add(line, sym)
+		return strings.TrimLeft(line[n:], " ")
+	}
+
+	return line
+}
+
+// resolveBroken adjusts the duration of sym for broken rhythm
+// with the previous note and with the next note.
+func (p *Parser) resolveBroken(line string, sym *Symbol) {
+	if sym.Kind == KindRest && sym.Value != "z" && sym.Value != "x" {
+		// spacers and multi-measure rests do not take part in broken rhythm
+		if sym.Broken != 0 {
+			p.warnf(line, "unexpected broken rhythm on %q", sym.Value)
+			sym.Broken = 0
+		}
+		return
+	}
+
+	if p.broken != 0 {
+		sym.Duration.Mul(&sym.Duration, brokenRatio(-p.broken))
+		p.broken = 0
+	}
+	switch {
+	case sym.Broken > maxBroken:
+		p.warnf(line, "broken rhythm longer than %d symbols", maxBroken)
+		sym.Broken = maxBroken
+	case sym.Broken < -maxBroken:
+		p.warnf(line, "broken rhythm longer than %d symbols", maxBroken)
+		sym.Broken = -maxBroken
+	}
+	if sym.Broken != 0 {
+		sym.Duration.Mul(&sym.Duration, brokenRatio(sym.Broken))
+		p.broken = sym.Broken
+	}
+}
+
+// maxBroken is the longest broken rhythm, `>>>` or `<<<`.
+const maxBroken = 3
+
+// danglingBroken warns about pending broken rhythm that is not followed by a note.
+func (p *Parser) danglingBroken(rest string) {
+	if p.broken == 0 {
+		return
+	}
+	p.warnf(rest, "broken rhythm without a following note")
+	p.broken = 0
+}
+
+// brokenRatio returns the duration multiplier for the first note
+// of broken rhythm n, e.g. 7/4 for `>>` and 1/4 for `<<`.
+func brokenRatio(n int) *big.Rat {
+	if n < 0 {
+		return big.NewRat(1, 1<<-n)
+	}
+	return big.NewRat(2<<n-1, 1<<n)
+}
+
+// ParseNote parses a single note, chord or rest from the start of s.
+// It returns the number of bytes consumed, which is 0 when s does not
+// start with a note.
+func ParseNote(s string) (sym Symbol, n int, err error) {
+	if match := rxNote.FindStringSubmatch(s); len(match) > 0 {
 		note := match[1]
 		duration := match[2]
 		halving := match[3]
 		divider := match[4]
-		syncopate := match[5]
+		broken := match[5]
 		tie := match[6]
 
 		dur := big.NewRat(1, 1)
 		if duration != "" {
-			v, err := strconv.Atoi(duration)
+			v, err := parsePositive(duration)
 			if err != nil {
-				// TODO: fix error handling
-				panic(err)
+				return Symbol{}, len(match[0]), fmt.Errorf("invalid note length %q: %w", match[0], err)
 			}
 			dur.Mul(dur, big.NewRat(int64(v), 1))
 		}
 		if len(halving) == 1 && divider != "" {
-			div, err := strconv.Atoi(divider)
+			div, err := parsePositive(divider)
 			if err != nil {
-				// TODO: fix error handling
-				panic(err)
+				return Symbol{}, len(match[0]), fmt.Errorf("invalid note length %q: %w", match[0], err)
 			}
 			dur.Mul(dur, big.NewRat(1, int64(div)))
 		} else {
@@ -197,7 +702,7 @@ func (p *Parser) TryParseNote(line string) string {
 		}
 
 		sync := 0
-		for _, b := range syncopate {
+		for _, b := range broken {
 			switch b {
 			case '<':
 				sync--
@@ -207,14 +712,17 @@ func (p *Parser) TryParseNote(line string) string {
 		}
 
 		if isRest(note) {
-			p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
-				Kind:        KindRest,
-				Value:       note,
-				Duration:    *dur,
-				Tie:         tie != "",
-				Syncopation: sync,
-			})
-			return strings.TrimLeft(line[len(match[0]):], " ")
+			if note == "y" && duration == "" && halving == "" {
+				// y without a length takes no time
+				dur.SetInt64(0)
+			}
+			return Symbol{
+				Kind:     KindRest,
+				Value:    note,
+				Duration: *dur,
+				Tie:      tie != "",
+				Broken:   sync,
+			}, len(match[0]), nil
 		}
 
 		var notes []Note
@@ -242,21 +750,19 @@ func (p *Parser) TryParseNote(line string) string {
 		}
 
 		if len(notes) == 0 {
-			panic("failed to parse note " + note)
+			return Symbol{}, len(match[0]), fmt.Errorf("failed to parse note %q", note)
 		}
 
-		p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
-			Kind:        KindNote,
-			Notes:       notes,
-			Duration:    *dur,
-			Tie:         tie != "",
-			Syncopation: sync,
-		})
-
-		return strings.TrimLeft(line[len(match[0]):], " ")
+		return Symbol{
+			Kind:     KindNote,
+			Notes:    notes,
+			Duration: *dur,
+			Tie:      tie != "",
+			Broken:   sync,
+		}, len(match[0]), nil
 	}
 
-	return line
+	return Symbol{}, 0, nil
 }
 
 func isRest(v string) bool {
@@ -271,9 +777,20 @@ var rxText = regexp.MustCompile(`^"([^"]*)"`) // TODO: handle escaping "
 
 func (p *Parser) TryParseText(line string) string {
 	if match := rxText.FindStringSubmatch(line); len(match) > 0 {
-		p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
-			Kind:  KindText,
-			Value: match[1],
+		if chord, ok := ParseChord(match[1]); ok {
+			p.add(line, Symbol{
+				Kind:  KindChord,
+				Value: match[1],
+				Chord: &chord,
+			})
+			return strings.TrimLeft(line[len(match[0]):], " ")
+		}
+
+		annotation := ParseAnnotation(match[1])
+		p.add(line, Symbol{
+			Kind:       KindText,
+			Value:      annotation.Text,
+			Annotation: &annotation,
 		})
 		return strings.TrimLeft(line[len(match[0]):], " ")
 	}
@@ -286,6 +803,8 @@ var rxBar = regexp.MustCompile(`^([\:\|\[\]]*[\:\|\]])(?:(?:\s*\[)?([0-9\-\,]+)|
 
 func (p *Parser) TryParseBar(line string) string {
 	if match := rxBar.FindStringSubmatch(line); len(match) > 0 {
+		p.danglingBroken(line)
+		p.danglingGrace()
 		bar := match[1]
 		volta := match[2]
 		end := match[3]
@@ -293,7 +812,7 @@ func (p *Parser) TryParseBar(line string) string {
 			volta = strings.TrimLeft(volta, " [")
 		}
 
-		p.Stave.Symbols = append(p.Stave.Symbols, Symbol{
+		p.add(line, Symbol{
 			Kind:  KindBar,
 			Value: bar,
 			Volta: volta,
@@ -306,39 +825,79 @@ func (p *Parser) TryParseBar(line string) string {
 	return line
 }
 
-func ParseMeter(s string) (m Meter) {
+// ParseMeter parses the value of `M:` field, e.g. `3/4`, `C|`, `2+3/8` or `none`.
+func ParseMeter(s string) (m Meter, err error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || strings.EqualFold(s, "none"):
+		return Meter{Free: true}, nil
+	case s == "C":
+		return Meter{BeatsPerMeasure: 4, BeatLength: 4, Symbol: "C"}, nil
+	case s == "C|":
+		return Meter{BeatsPerMeasure: 2, BeatLength: 2, Symbol: "C|"}, nil
+	}
+
 	beatsPerMeasure, beatLength, ok := strings.Cut(s, "/")
 	if !ok {
-		panic("invalid meter " + s)
+		return Meter{}, fmt.Errorf("invalid meter %q", s)
 	}
 
-	var err1, err2 error
-	m.BeatsPerMeasure, err1 = strconv.Atoi(beatsPerMeasure)
-	m.BeatLength, err2 = strconv.Atoi(beatLength)
-
-	if err1 != nil || err2 != nil {
-		// TODO: error handling
-		panic(fmt.Errorf("%w\n%w", err1, err2))
+	beatsPerMeasure = strings.TrimSpace(beatsPerMeasure)
+	if strings.HasPrefix(beatsPerMeasure, "(") && strings.HasSuffix(beatsPerMeasure, ")") {
+		beatsPerMeasure = beatsPerMeasure[1 : len(beatsPerMeasure)-1]
+	}
+	if strings.Contains(beatsPerMeasure, "+") {
+		for _, group := range strings.Split(beatsPerMeasure, "+") {
+			n, err := parsePositive(group)
+			if err != nil {
+				return Meter{}, fmt.Errorf("invalid meter %q: %w", s, err)
+			}
+			m.Groups = append(m.Groups, n)
+			m.BeatsPerMeasure += n
+		}
+	} else {
+		m.BeatsPerMeasure, err = parsePositive(beatsPerMeasure)
+		if err != nil {
+			return Meter{}, fmt.Errorf("invalid meter %q: %w", s, err)
+		}
+	}
+	m.BeatLength, err = parsePositive(beatLength)
+	if err != nil {
+		return Meter{}, fmt.Errorf("invalid meter %q: %w", s, err)
 	}
 
-	return m
+	return m, nil
 }
 
-func ParseNoteLength(s string) (n big.Rat) {
+func ParseNoteLength(s string) (n big.Rat, err error) {
 	as, bs, ok := strings.Cut(s, "/")
 	if !ok {
-		panic("invalid meter " + s)
+		return n, fmt.Errorf("invalid note length %q", s)
 	}
 
-	a, err1 := strconv.Atoi(as)
-	b, err2 := strconv.Atoi(bs)
-
-	if err1 != nil || err2 != nil {
-		// TODO: error handling
-		panic(fmt.Errorf("%w\n%w", err1, err2))
+	a, err := parsePositive(as)
+	if err != nil {
+		return n, fmt.Errorf("invalid note length %q: %w", s, err)
+	}
+	b, err := parsePositive(bs)
+	if err != nil {
+		return n, fmt.Errorf("invalid note length %q: %w", s, err)
 	}
 
-	return *big.NewRat(int64(a), int64(b))
+	n.SetFrac64(int64(a), int64(b))
+	return n, nil
+}
+
+// parsePositive parses a number that must be larger than zero.
+func parsePositive(s string) (int, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("expected a positive number, got %d", v)
+	}
+	return v, nil
 }
 
 func trimTrailingWhitespace(line string) string {
@@ -355,29 +914,72 @@ func trimComment(line string) string {
 }
 
 type TuneBook struct {
-	Tunes []*Tune
+	// Header contains the fields of the file header,
+	// which apply to every tune.
+	Header Fields
+	Tunes  []*Tune
 }
 
 type Tune struct {
+	Pos
 	ID     string
 	Title  string
-	Key    string
+	Key    Key
 	Fields Fields
+	// Header is the file header of the tunebook.
+	Header Fields
 
 	Meter Meter
+	// Parts is the playing order of the parts.
+	Parts PartOrder
 
 	Body TuneBody
 
 	Raw string
+
+	// Failed is set when the tune could not be parsed properly.
+	Failed bool
 }
 
 type Meter struct {
 	BeatsPerMeasure int
 	BeatLength      int
+
+	// Groups contains the additive numerator, e.g. [2 3] for `2+3/8`.
+	Groups []int
+	// Symbol is "C" for common time and "C|" for cut time.
+	Symbol string
+	// Free is set for `M:none`, which has no bars of fixed length.
+	Free bool
+}
+
+// IsCompound returns whether the meter is a compound meter, e.g. 6/8, 9/8 or 12/8.
+func (m Meter) IsCompound() bool {
+	return m.BeatLength == 8 && m.BeatsPerMeasure > 3 && m.BeatsPerMeasure%3 == 0
 }
 
 type TuneBody struct {
-	Staves []Stave
+	Voices []*Voice
+}
+
+// Field finds the field from the tune or the file header.
+func (tune *Tune) Field(tag string) (Field, bool) {
+	if f, ok := tune.Fields.ByTag(tag); ok {
+		return f, true
+	}
+	return tune.Header.ByTag(tag)
+}
+
+// AllFields returns the file header fields not overridden by the tune,
+// followed by the tune fields.
+func (tune *Tune) AllFields() Fields {
+	var fields Fields
+	for _, f := range tune.Header {
+		if _, ok := tune.Fields.ByTag(f.Tag); !ok {
+			fields = append(fields, f)
+		}
+	}
+	return append(fields, tune.Fields...)
 }
 
 type Fields []Field
@@ -392,28 +994,87 @@ func (fields Fields) ByTag(tag string) (Field, bool) {
 }
 
 type Field struct {
+	Pos
 	Tag   string
 	Value string
 }
 
 type Stave struct {
 	Symbols []Symbol
+	// Lyrics contains aligned syllables for every verse.
+	Lyrics [][]Syllable
 }
 
-type Symbol struct {
-	Kind        Kind
-	Value       string
-	Notes       []Note
-	Duration    big.Rat
-	Syncopation int
+// hasMusic returns whether the stave contains anything besides fields.
+func (stave *Stave) hasMusic() bool {
+	for _, sym := range stave.Symbols {
+		if sym.Kind != KindField {
+			return true
+		}
+	}
+	return false
+}
 
-	Tie   bool
-	Tag   string
-	Volta string
+type Symbol struct {
+	Pos
+	Kind     Kind
+	Value    string
+	Notes    []Note
+	Duration big.Rat
+	// Broken is the broken rhythm with the next note, 1 for `>`, 2 for `>>`
+	// and -1 for `<`. Duration of both notes includes the broken rhythm.
+	Broken int
+
+	Tie    bool
+	Dotted bool
+	Tag    string
+	Volta  string
+	Tuplet Tuplet
+	Grace  *Grace
+	Chord  *Chord
+
+	Annotation *Annotation
 
 	CloseVolta bool
 }
 
+// Grace is a group of grace notes preceding a note.
+type Grace struct {
+	Pos
+	// Acciaccatura is set for the slashed form `{/g}`.
+	Acciaccatura bool
+	Notes        []Symbol
+}
+
+// Tuplet describes `(p:q:r`, which means
+// put p notes into the time of q for the next r notes.
+type Tuplet struct {
+	P, Q, R int
+}
+
+// WithDefaults fills in the unspecified Q and R
+// according to the ABC standard.
+func (t Tuplet) WithDefaults(meter Meter) Tuplet {
+	if t.Q == 0 {
+		switch t.P {
+		case 2, 4, 8:
+			t.Q = 3
+		case 3, 6:
+			t.Q = 2
+		default:
+			if meter.IsCompound() {
+				t.Q = 3
+			} else {
+				t.Q = 2
+			}
+		}
+	}
+	if t.R == 0 {
+		t.R = t.P
+	}
+	return t
+}
+
 type Note struct {
 	Accidentals string
 	Pitch       string
@@ -440,18 +1101,30 @@ func (k Kind) String() string {
 		return "Deco"
 	case KindField:
 		return "Field"
+	case KindTuplet:
+		return "Tuplet"
+	case KindSlurStart:
+		return "SlurStart"
+	case KindSlurEnd:
+		return "SlurEnd"
+	case KindChord:
+		return "Chord"
 	default:
 		return fmt.Sprintf("Kind(%d)", k)
 	}
 }
 
 const (
-	KindText  = Kind(1)
-	KindNote  = Kind(2)
-	KindRest  = Kind(3)
-	KindBar   = Kind(4)
-	KindDeco  = Kind(5)
-	KindField = Kind(6)
+	KindText      = Kind(1)
+	KindNote      = Kind(2)
+	KindRest      = Kind(3)
+	KindBar       = Kind(4)
+	KindDeco      = Kind(5)
+	KindField     = Kind(6)
+	KindTuplet    = Kind(7)
+	KindSlurStart = Kind(8)
+	KindSlurEnd   = Kind(9)
+	KindChord     = Kind(10)
 )
 
 type FieldDef struct {
@@ -534,11 +1207,21 @@ var FieldDefs = []FieldDef{
 	FieldUserDefined,
 	FieldVoice,
 	FieldWords,
-	FieldWords,
+	FieldWords2,
 	FieldReferenceNumber,
 	FieldTranscription,
 }
 
+// FieldDefByTag finds the field definition for tag.
+func FieldDefByTag(tag string) (FieldDef, bool) {
+	for _, def := range FieldDefs {
+		if def.Tag == tag {
+			return def, true
+		}
+	}
+	return FieldDef{}, false
+}
+
 const (
 	AccidentalFlat    = '_'
 	AccidentalSharp   = '^'
@@ -2,7 +2,11 @@ package abc
 
 import (
 	_ "embed"
+	"math/big"
+	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 //go:embed testdata/simple.abc
@@ -31,12 +35,443 @@ func TestSimple(t *testing.T) {
 		t.Error(warn)
 	}
 	for _, tune := range book.Tunes {
-		for _, stave := range tune.Body.Staves {
-			t.Log("stave")
+		for _, voice := range tune.Body.Voices {
+			for _, stave := range voice.Staves {
+				t.Log("stave")
+				for _, sym := range stave.Symbols {
+					t.Logf("%v\n", sym)
+				}
+			}
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	book, warnings := Parse("\n\nX: 1\nT: Positions\nK: C\nab |\n  c ?? d\n\nX: 2\nK: D\n|: d2 :|\n")
+	require(t, 2, len(book.Tunes))
+	require(t, 1, len(warnings))
+	require(t, Pos{Line: 7, Column: 5}, warnings[0].Pos)
+
+	first := book.Tunes[0]
+	require(t, Pos{Line: 3, Column: 1}, first.Pos)
+	require(t, Pos{Line: 4, Column: 1}, first.Fields[1].Pos)
+
+	symbols := first.Body.Voices[0].Staves[0].Symbols
+	require(t, Pos{Line: 6, Column: 2}, symbols[1].Pos)
+	require(t, Pos{Line: 6, Column: 4}, symbols[2].Pos)
+
+	second := book.Tunes[1]
+	require(t, Pos{Line: 9, Column: 1}, second.Pos)
+	symbols = second.Body.Voices[0].Staves[0].Symbols
+	require(t, Pos{Line: 11, Column: 4}, symbols[1].Pos)
+}
+
+func TestFileHeader(t *testing.T) {
+	book, warnings := Parse("%abc-2.1\nC: Trad.\nL: 1/8\n%%papersize A4\n\nX: 1\nT: A\nM: 6/8\nK: G\nGAB |\n\nX: 2\nL: 1/4\nK: D\nd |\n")
+	for _, warn := range warnings {
+		t.Error(warn)
+	}
+	require(t, 3, len(book.Header))
+	require(t, "papersize A4", book.Header[2].Value)
+	require(t, 2, len(book.Tunes))
+
+	length, _ := book.Tunes[0].Field(FieldUnitNoteLength.Tag)
+	require(t, "1/8", length.Value)
+	length, _ = book.Tunes[1].Field(FieldUnitNoteLength.Tag)
+	require(t, "1/4", length.Value)
+	composer, _ := book.Tunes[1].Field(FieldComposer.Tag)
+	require(t, "Trad.", composer.Value)
+}
+
+func TestRecover(t *testing.T) {
+	book, warnings := Parse("X: 1\nM: 3/x\nL: 1/0\nK: C\nabc |\n\nX: 2\nK: C\na99999999999999999999 b/0 c |\n\nX: 3\nK: C\n[L:x] abc |\n")
+	require(t, 3, len(book.Tunes))
+	require(t, true, book.Tunes[0].Failed)
+	require(t, false, book.Tunes[1].Failed)
+	require(t, false, book.Tunes[2].Failed)
+	require(t, 5, len(warnings))
+	for _, warn := range warnings {
+		t.Log(warn)
+	}
+
+	symbols := book.Tunes[1].Body.Voices[0].Staves[0].Symbols
+	require(t, 2, len(symbols))
+}
+
+func TestParseChord(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect Chord
+		ok     bool
+	}{
+		{"C", Chord{Root: "C"}, true},
+		{"Am7/G", Chord{Root: "A", Quality: "m", Extensions: []string{"7"}, Bass: "G"}, true},
+		{"D(b9)", Chord{Root: "D", Extensions: []string{"b9"}}, true},
+		{"Bbmaj7", Chord{Root: "Bb", Extensions: []string{"maj7"}}, true},
+		{"Cmmaj7", Chord{Root: "C", Quality: "m", Extensions: []string{"maj7"}}, true},
+		{"F#ø7", Chord{Root: "F#", Quality: "m", Extensions: []string{"7", "b5"}}, true},
+		{"Esus4", Chord{Root: "E", Extensions: []string{"sus4"}}, true},
+		{"N.C.", Chord{}, true},
+		{"Fine", Chord{}, false},
+		{"rit.", Chord{}, false},
+		{"D.C.", Chord{}, false},
+	}
+	for _, test := range tests {
+		chord, ok := ParseChord(test.in)
+		if ok != test.ok {
+			t.Errorf("%q: expected ok=%v", test.in, test.ok)
+			continue
+		}
+		if diff := cmp.Diff(test.expect, chord); diff != "" {
+			t.Errorf("%q: %s", test.in, diff)
+		}
+	}
+}
+
+func TestParseMeter(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect Meter
+	}{
+		{"3/4", Meter{BeatsPerMeasure: 3, BeatLength: 4}},
+		{"C", Meter{BeatsPerMeasure: 4, BeatLength: 4, Symbol: "C"}},
+		{"C|", Meter{BeatsPerMeasure: 2, BeatLength: 2, Symbol: "C|"}},
+		{"2+3/8", Meter{BeatsPerMeasure: 5, BeatLength: 8, Groups: []int{2, 3}}},
+		{"(2+2+3)/8", Meter{BeatsPerMeasure: 7, BeatLength: 8, Groups: []int{2, 2, 3}}},
+		{"none", Meter{Free: true}},
+	}
+	for _, test := range tests {
+		meter, err := ParseMeter(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(test.expect, meter); diff != "" {
+			t.Errorf("%q: %s", test.in, diff)
+		}
+	}
+}
+
+func TestDefaultUnitNoteLength(t *testing.T) {
+	tests := []struct {
+		meter  string
+		expect *big.Rat
+	}{
+		{"2/4", big.NewRat(1, 16)},
+		{"3/8", big.NewRat(1, 16)},
+		{"3/4", big.NewRat(1, 8)},
+		{"6/8", big.NewRat(1, 8)},
+		{"C", big.NewRat(1, 8)},
+		{"C|", big.NewRat(1, 8)},
+		{"none", big.NewRat(1, 8)},
+	}
+	for _, test := range tests {
+		meter, err := ParseMeter(test.meter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length := DefaultUnitNoteLength(meter)
+		if length.Cmp(test.expect) != 0 {
+			t.Errorf("%q: expected %v, got %v", test.meter, test.expect, &length)
+		}
+	}
+}
+
+func TestParseTempo(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect Tempo
+	}{
+		{`"Allegro" 1/4=120`, Tempo{Text: "Allegro", Beats: []big.Rat{*big.NewRat(1, 4)}, BPM: 120}},
+		{`3/8=40`, Tempo{Beats: []big.Rat{*big.NewRat(3, 8)}, BPM: 40}},
+		{`1/4 3/8=40 "Lively"`, Tempo{Text: "Lively", Beats: []big.Rat{*big.NewRat(1, 4), *big.NewRat(3, 8)}, BPM: 40}},
+		{`C=100`, Tempo{BPM: 100, Relative: true}},
+		{`120`, Tempo{BPM: 120, Relative: true}},
+		{`"Slowly"`, Tempo{Text: "Slowly"}},
+	}
+	for _, test := range tests {
+		tempo, err := ParseTempo(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if diff := cmp.Diff(test.expect, tempo, cmp.Comparer(func(a, b big.Rat) bool { return a.Cmp(&b) == 0 })); diff != "" {
+			t.Errorf("%q: %s", test.in, diff)
+		}
+	}
+
+	for _, in := range []string{"", "1/4", "1/4=fast"} {
+		if _, err := ParseTempo(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestBrokenRhythm(t *testing.T) {
+	book, warnings := Parse("X: 1\nL: 1/8\nK: C\nA>B A>>B A<<<B [CE]>z z<A |\n")
+	for _, warn := range warnings {
+		t.Error(warn)
+	}
+
+	var durations []string
+	for _, sym := range book.Tunes[0].Body.Voices[0].Staves[0].Symbols {
+		if sym.Kind == KindNote || sym.Kind == KindRest {
+			durations = append(durations, sym.Duration.RatString())
+		}
+	}
+	require(t, "3/2 1/2 7/4 1/4 1/8 15/8 3/2 1/2 1/2 3/2", strings.Join(durations, " "))
+}
+
+func TestBrokenRhythmVoices(t *testing.T) {
+	book, warnings := Parse("X: 1\nL: 1/8\nK: C\nV:1\nA B c>\nV:2\nd e f |\n")
+	require(t, 1, len(warnings))
+	require(t, "5:7: broken rhythm without a following note", warnings[0].String())
+
+	voices := book.Tunes[0].Body.Voices
+	require(t, 2, len(voices))
+	require(t, "3/2", voices[0].Staves[0].Symbols[2].Duration.RatString())
+	require(t, "1", voices[1].Staves[0].Symbols[0].Duration.RatString())
+}
+
+func TestBrokenRhythmLimit(t *testing.T) {
+	book, warnings := Parse("X: 1\nL: 1/8\nK: C\nA B>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>c |\n")
+	require(t, 1, len(warnings))
+	require(t, "4:3: broken rhythm longer than 3 symbols", warnings[0].String())
+	require(t, false, book.Tunes[0].Failed)
+
+	symbols := book.Tunes[0].Body.Voices[0].Staves[0].Symbols
+	require(t, "15/8", symbols[1].Duration.RatString())
+	require(t, "1/8", symbols[2].Duration.RatString())
+}
+
+func TestGrace(t *testing.T) {
+	book, warnings := Parse("X: 1\nK: C\n{/g a}A {g}| B {e}z c {f}\n")
+	require(t, 3, len(warnings))
+	require(t, "3:9: grace notes without a following note", warnings[0].String())
+	require(t, "3:16: grace notes without a following note", warnings[1].String())
+	require(t, "3:23: grace notes without a following note", warnings[2].String())
+
+	symbols := book.Tunes[0].Body.Voices[0].Staves[0].Symbols
+	grace := symbols[0].Grace
+	require(t, 2, len(grace.Notes))
+	require(t, Pos{Line: 3, Column: 3}, grace.Notes[0].Pos)
+	require(t, Pos{Line: 3, Column: 5}, grace.Notes[1].Pos)
+	for _, sym := range symbols[1:] {
+		if sym.Grace != nil {
+			t.Errorf("unexpected grace notes on %v", sym)
+		}
+	}
+}
+
+func TestDecorations(t *testing.T) {
+	book, warnings := Parse("X: 1\nK: C\nTA !trill!B +trill+c !unknown!d |\n")
+	require(t, 1, len(warnings))
+	require(t, Pos{Line: 3, Column: 22}, warnings[0].Pos)
+
+	var names []string
+	for _, sym := range book.Tunes[0].Body.Voices[0].Staves[0].Symbols {
+		if sym.Kind == KindDeco {
+			names = append(names, DecorationName(sym.Value))
+		}
+	}
+	require(t, "trill trill trill unknown", strings.Join(names, " "))
+}
+
+func TestHairpins(t *testing.T) {
+	_, warnings := Parse("X: 1\nK: C\n!<(!A B |\nc !<)!d | !>)!e !>(!f |\n")
+	require(t, 2, len(warnings))
+	require(t, "4:11: hairpin end without a start", warnings[0].String())
+	require(t, "4:17: hairpin is never closed", warnings[1].String())
+}
+
+func TestAnalyzeRepeats(t *testing.T) {
+	book, warnings := Parse("X: 1\nL: 1/4\nK: C\nC D :: E F |1,3 G :|2 A :|4 B || c |]\n")
+	for _, warn := range warnings {
+		t.Error(warn)
+	}
+	repeats, err := AnalyzeRepeats(book.Tunes[0].Body.Voices[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	require(t, 2, len(repeats))
+	require(t, -1, repeats[0].Start.Symbol)
+	require(t, 2, repeats[0].Times)
+	require(t, 4, repeats[1].Times)
+	require(t, 3, len(repeats[1].Endings))
+	require(t, "1,3", repeats[1].Endings[0].VoltaString())
+
+	book, _ = Parse("X: 1\nL: 1/4\nK: C\n|: C D |: E F :|\n")
+	if _, err := AnalyzeRepeats(book.Tunes[0].Body.Voices[0]); err == nil {
+		t.Error("expected error for nested repeat")
+	}
+}
+
+func TestParsePartOrder(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"ABAC", "ABAC"},
+		{"A.B.A.C", "ABAC"},
+		{"A2B2", "AABB"},
+		{"(AB)3C", "ABABABC"},
+		{"((AB)2C)2", "ABABCABABC"},
+	}
+	for _, test := range tests {
+		order, err := ParsePartOrder(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if got := strings.Join(order.Expand(), ""); got != test.expect {
+			t.Errorf("%q: expected %q, got %q", test.in, test.expect, got)
+		}
+	}
+
+	for _, in := range []string{"(AB", "AB)", "a"} {
+		if _, err := ParsePartOrder(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestUnfold(t *testing.T) {
+	book, warnings := Parse("X: 1\nM: 2/4\nL: 1/4\nP: A2B\nK: C\nP: A\nC D |\nE F | [P:B] G A |]\nw: one two\n")
+	for _, warn := range warnings {
+		t.Error(warn)
+	}
+	tune := book.Tunes[0].Unfold()
+
+	var pitches string
+	var lyrics []string
+	for _, stave := range tune.Body.Voices[0].Staves {
+		for _, sym := range stave.Symbols {
+			if sym.Kind == KindNote {
+				pitches += sym.Notes[0].Pitch
+			}
+		}
+		for _, verse := range stave.Lyrics {
+			for _, syllable := range verse {
+				if syllable.Text != "" {
+					lyrics = append(lyrics, syllable.Text)
+				}
+			}
+		}
+	}
+	require(t, "cdefcdefga", pitches)
+	require(t, "one two one two", strings.Join(lyrics, " "))
+}
+
+func TestUnfoldJumps(t *testing.T) {
+	tests := []struct {
+		music   string
+		pitches string
+	}{
+		{"C D | E F |]", "cdef"},
+		{"C D | E F !D.C.!|]", "cdefcdef"},
+		{"C D | !segno!E F |\nG A !D.S.!|]", "cdefgaefga"},
+		{"C D !fine!| E F !D.C.alfine!|]", "cdefcd"},
+		{"C D | S E !dacoda!F | G A !D.S.alcoda!|| !coda!B c |]", "cdefgaefbc"},
+		{"C O D | E F | G !D.C.!A | O B c |]", "cdefgacdbc"},
+	}
+	for _, test := range tests {
+		book, warnings := Parse("X: 1\nM: 2/4\nL: 1/4\nK: C\n" + test.music + "\n")
+		for _, warn := range warnings {
+			t.Error(warn)
+		}
+		tune, err := book.Tunes[0].UnfoldJumps()
+		if err != nil {
+			t.Errorf("%q: %v", test.music, err)
+			continue
+		}
+
+		var pitches string
+		for _, stave := range tune.Body.Voices[0].Staves {
 			for _, sym := range stave.Symbols {
-				t.Logf("%v\n", sym)
+				if sym.Kind == KindNote {
+					pitches += sym.Notes[0].Pitch
+				}
 			}
 		}
+		if pitches != test.pitches {
+			t.Errorf("%q: expected %q, got %q", test.music, test.pitches, pitches)
+		}
+	}
+
+	book, _ := Parse("X: 1\nK: C\nC D | E F !D.S.!|]\n")
+	if _, err := book.Tunes[0].UnfoldJumps(); err == nil {
+		t.Errorf("expected an error for D.S. without a segno")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in          string
+		tonic, mode string
+		accidentals map[string]int
+	}{
+		{"G", "G", "major", map[string]int{"f": 1}},
+		{"Dm", "D", "minor", map[string]int{"b": -1}},
+		{"D Mixolydian", "D", "mixolydian", map[string]int{"f": 1}},
+		{"Ador", "A", "dorian", map[string]int{"f": 1}},
+		{"F#MIN", "F#", "minor", map[string]int{"f": 1, "c": 1, "g": 1}},
+		{"Bb lyd", "Bb", "lydian", map[string]int{"b": -1}},
+		{"D ^g", "D", "major", map[string]int{"f": 1, "c": 1, "g": 1}},
+		{"D exp ^f _b", "D", "major", map[string]int{"f": 1, "b": -1}},
+		{"none", "", "", map[string]int{}},
+	}
+	for _, test := range tests {
+		key, err := ParseKey(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if key.Tonic != test.tonic || key.Mode != test.mode {
+			t.Errorf("%q: got %q %q", test.in, key.Tonic, key.Mode)
+		}
+		if diff := cmp.Diff(test.accidentals, key.AccidentalMap()); diff != "" {
+			t.Errorf("%q: %s", test.in, diff)
+		}
+	}
+
+	for _, in := range []string{"Dfoo", "G#", "Xyz", "D foo"} {
+		if _, err := ParseKey(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestClefOctaveShift(t *testing.T) {
+	tests := []struct {
+		in    string
+		shift int
+	}{
+		{"C", 0},
+		{"C bass", 0},
+		{"C treble-8", -1},
+		{"C clef=treble+8", 1},
+		{"C bass middle=d", -2},
+		{"C alto middle=c", -1},
+		{"C octave=-1", -1},
+		{"C bass3 middle=F", -1},
+		{"bass", 0},
+		{"alto", 0},
+		{"bass middle=d", -2},
+	}
+	for _, test := range tests {
+		key, err := ParseKey(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		shift, err := key.Clef.OctaveShift()
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if shift != test.shift {
+			t.Errorf("%q: expected %d, got %d", test.in, test.shift, shift)
+		}
 	}
 }
 
@@ -0,0 +1,299 @@
+package abc
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PartOrder is the playing order of parts from `P:` in the tune header,
+// e.g. `P:(AB)3C`.
+type PartOrder []Part
+
+// Part is a single part label or a group of parts in the playing order.
+type Part struct {
+	// Label is the part label, empty for a group.
+	Label string
+	// Group contains the parts inside parentheses.
+	Group PartOrder
+	// Repeat is the number of times the part is played.
+	Repeat int
+}
+
+// ParsePartOrder parses the playing order, e.g. `A.B.A.C` or `((AB)2C)2`.
+func ParsePartOrder(s string) (PartOrder, error) {
+	order, rest, err := parsePartOrder(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid part order %q: unexpected %q", s, rest)
+	}
+	return order, nil
+}
+
+func parsePartOrder(s string) (order PartOrder, rest string, err error) {
+	for s != "" {
+		var part Part
+		switch c := s[0]; {
+		case c == '.' || c == ' ' || c == '\t':
+			s = s[1:]
+			continue
+		case c == ')':
+			return order, s, nil
+		case c >= 'A' && c <= 'Z':
+			part.Label, s = s[:1], s[1:]
+		case c == '(':
+			part.Group, s, err = parsePartOrder(s[1:])
+			if err != nil {
+				return nil, s, err
+			}
+			if s == "" || s[0] != ')' {
+				return nil, s, fmt.Errorf("invalid part order: missing )")
+			}
+			s = s[1:]
+		default:
+			return nil, s, fmt.Errorf("invalid part order: unexpected %q", s[:1])
+		}
+
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		part.Repeat = 1
+		if n > 0 {
+			part.Repeat, _ = strconv.Atoi(s[:n])
+			s = s[n:]
+		}
+		order = append(order, part)
+	}
+	return order, "", nil
+}
+
+// Expand returns the part labels in playing order.
+func (order PartOrder) Expand() []string {
+	var labels []string
+	for _, part := range order {
+		for range make([]struct{}, part.Repeat) {
+			if part.Label != "" {
+				labels = append(labels, part.Label)
+			} else {
+				labels = append(labels, part.Group.Expand()...)
+			}
+		}
+	}
+	return labels
+}
+
+// Unfold returns a copy of the tune where the music of every voice
+// is rearranged in the playing order of the parts. Every part starts
+// with the meter, unit note length and key it was written in and only
+// the last part ends with a final bar.
+func (tune *Tune) Unfold() *Tune {
+	if len(tune.Parts) == 0 {
+		return tune
+	}
+	order := tune.Parts.Expand()
+
+	unfolded := *tune
+	unfolded.Parts = nil
+	unfolded.Body.Voices = nil
+	for _, voice := range tune.Body.Voices {
+		split := splitParts(voice)
+
+		v := *voice
+		v.Staves = split.intro
+		current := split.introEnd
+		for _, label := range order {
+			staves := split.parts[label]
+			if len(staves) == 0 {
+				continue
+			}
+			if restore := tune.restoreFields(current, split.starts[label]); len(restore) > 0 {
+				staves = append([]Stave{withFields(staves[0], restore)}, staves[1:]...)
+			}
+			v.Staves = append(v.Staves, staves...)
+			current = split.ends[label]
+		}
+		v.Staves = withoutInteriorFinalBars(v.Staves)
+		unfolded.Body.Voices = append(unfolded.Body.Voices, &v)
+	}
+	return &unfolded
+}
+
+// musicState contains the values of the last meter, unit note length
+// and key fields in the music, empty when the tune header applies.
+type musicState struct {
+	Meter          string
+	UnitNoteLength string
+	Key            string
+}
+
+// apply updates the state with the field symbol.
+func (state *musicState) apply(sym Symbol) {
+	switch sym.Tag {
+	case FieldMeter.Tag:
+		state.Meter = sym.Value
+	case FieldUnitNoteLength.Tag:
+		state.UnitNoteLength = sym.Value
+	case FieldKey.Tag:
+		state.Key = sym.Value
+	}
+}
+
+// restoreFields returns the fields that change the state from current to next.
+func (tune *Tune) restoreFields(current, next musicState) []Symbol {
+	meter := tune.Meter
+	if next.Meter != "" {
+		meter, _ = ParseMeter(next.Meter)
+	}
+
+	var fields []Symbol
+	restore := func(tag, from, to string) {
+		if from == to {
+			return
+		}
+		if to == "" {
+			f, ok := tune.Field(tag)
+			switch {
+			case ok:
+				to = f.Value
+			case tag == FieldMeter.Tag:
+				to = "none"
+			case tag == FieldUnitNoteLength.Tag:
+				length := DefaultUnitNoteLength(meter)
+				to = length.Num().String() + "/" + length.Denom().String()
+			default:
+				return
+			}
+		}
+		fields = append(fields, Symbol{Kind: KindField, Tag: tag, Value: to})
+	}
+	restore(FieldMeter.Tag, current.Meter, next.Meter)
+	restore(FieldUnitNoteLength.Tag, current.UnitNoteLength, next.UnitNoteLength)
+	restore(FieldKey.Tag, current.Key, next.Key)
+	return fields
+}
+
+// withFields returns a copy of the stave with fields added after the part label.
+func withFields(stave Stave, fields []Symbol) Stave {
+	at := 0
+	if len(stave.Symbols) > 0 && stave.Symbols[0].Kind == KindField && stave.Symbols[0].Tag == FieldParts.Tag {
+		at = 1
+		for i := range fields {
+			fields[i].Pos = stave.Symbols[0].Pos
+		}
+	}
+	symbols := append([]Symbol{}, stave.Symbols[:at]...)
+	symbols = append(symbols, fields...)
+	stave.Symbols = append(symbols, stave.Symbols[at:]...)
+	return stave
+}
+
+// withoutInteriorFinalBars replaces final bars before the last one with regular bars.
+func withoutInteriorFinalBars(staves []Stave) []Stave {
+	last := -1
+	for stavei := range staves {
+		for _, sym := range staves[stavei].Symbols {
+			if sym.Kind == KindBar && sym.Value == "|]" {
+				last = stavei
+			}
+		}
+	}
+
+	result := make([]Stave, len(staves))
+	for stavei, stave := range staves {
+		result[stavei] = stave
+		if stavei >= last {
+			continue
+		}
+		symbols := append([]Symbol{}, stave.Symbols...)
+		for i := range symbols {
+			if symbols[i].Kind == KindBar && symbols[i].Value == "|]" {
+				symbols[i].Value = "|"
+			}
+		}
+		result[stavei].Symbols = symbols
+	}
+	return result
+}
+
+// voiceParts is the music of a voice split at the part labels.
+type voiceParts struct {
+	intro []Stave
+	parts map[string][]Stave
+
+	// introEnd is the state at the end of the intro,
+	// starts and ends are the states at the start and end of every part.
+	introEnd     musicState
+	starts, ends map[string]musicState
+}
+
+// splitParts splits the staves of the voice at the part labels.
+func splitParts(voice *Voice) voiceParts {
+	split := voiceParts{
+		parts:  map[string][]Stave{},
+		starts: map[string]musicState{},
+		ends:   map[string]musicState{},
+	}
+	label := ""
+	var state musicState
+	add := func(stave Stave) {
+		if len(stave.Symbols) == 0 {
+			return
+		}
+		if label == "" {
+			split.intro = append(split.intro, stave)
+		} else {
+			split.parts[label] = append(split.parts[label], stave)
+		}
+	}
+	leave := func() {
+		if label == "" {
+			split.introEnd = state
+		} else {
+			split.ends[label] = state
+		}
+	}
+
+	for _, stave := range voice.Staves {
+		notes := 0
+		for i := 0; i < len(stave.Symbols); i++ {
+			sym := stave.Symbols[i]
+			switch {
+			case sym.Kind == KindField && sym.Tag == FieldParts.Tag:
+				var head Stave
+				head, stave = splitStave(stave, i, notes)
+				add(head)
+				leave()
+				label = sym.Value
+				if _, ok := split.starts[label]; !ok {
+					split.starts[label] = state
+				}
+				i, notes = 0, 0
+			case sym.Kind == KindField:
+				state.apply(sym)
+			case sym.Kind == KindNote:
+				notes++
+			}
+		}
+		add(stave)
+	}
+	leave()
+	return split
+}
+
+// splitStave splits the stave before symbol i,
+// notes is the number of notes before the split.
+func splitStave(stave Stave, i, notes int) (head, tail Stave) {
+	head.Symbols = stave.Symbols[:i:i]
+	tail.Symbols = stave.Symbols[i:]
+	for _, verse := range stave.Lyrics {
+		n := notes
+		if n > len(verse) {
+			n = len(verse)
+		}
+		head.Lyrics = append(head.Lyrics, verse[:n:n])
+		tail.Lyrics = append(tail.Lyrics, verse[n:])
+	}
+	return head, tail
+}
@@ -0,0 +1,222 @@
+package abc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SymbolRef refers to a symbol in a voice.
+type SymbolRef struct {
+	Stave  int
+	Symbol int
+}
+
+// Repeat is a repeated section of a voice,
+// e.g. `|: A :|` or `|: A |1 B :|2 C ||`.
+type Repeat struct {
+	// Start is the bar starting the repeat, Symbol is -1 when
+	// the repeat starts at the beginning of the stave.
+	Start SymbolRef
+	// End is the bar ending the repeated section,
+	// which is the first volta bar when the repeat has endings.
+	End SymbolRef
+	// Times is the number of times the section is played.
+	Times int
+	// Endings contains the alternative endings.
+	Endings []Ending
+}
+
+// Ending is an alternative ending of a repeat, e.g. `[1,3`.
+type Ending struct {
+	// Numbers contains the passes that use this ending.
+	Numbers []int
+	// Start is the bar with the volta and End is the bar after the ending.
+	// End.Stave is the number of staves when the ending continues
+	// until the end of the voice.
+	Start, End SymbolRef
+}
+
+// ParseVolta parses volta numbers, e.g. `1`, `1,3` or `2-4`.
+func ParseVolta(s string) ([]int, error) {
+	var numbers []int
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		a, err := parsePositive(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volta %q: %w", s, err)
+		}
+		b := a
+		if isRange {
+			b, err = parsePositive(to)
+			if err != nil || b < a {
+				return nil, fmt.Errorf("invalid volta %q", s)
+			}
+		}
+		for k := a; k <= b; k++ {
+			numbers = append(numbers, k)
+		}
+	}
+	return numbers, nil
+}
+
+// AnalyzeRepeats finds the repeated sections of the voice. It returns an
+// error when the repeats do not form regular sections with endings.
+func AnalyzeRepeats(voice *Voice) ([]Repeat, error) {
+	var repeats []Repeat
+
+	var open *Repeat
+	var ending *Ending
+	// implicitStart is where a repeat without `|:` starts
+	implicitStart := SymbolRef{Stave: 0, Symbol: -1}
+
+	finish := func(end SymbolRef) error {
+		if ending != nil {
+			ending.End = end
+			open.Endings = append(open.Endings, *ending)
+			ending = nil
+		}
+		if err := open.checkEndings(); err != nil {
+			return err
+		}
+		repeats = append(repeats, *open)
+		open = nil
+		implicitStart = end
+		return nil
+	}
+	startEnding := func(ref SymbolRef, volta string) error {
+		numbers, err := ParseVolta(volta)
+		if err != nil {
+			return err
+		}
+		ending = &Ending{Numbers: numbers, Start: ref}
+		return nil
+	}
+
+	for stavei, stave := range voice.Staves {
+		for symi, sym := range stave.Symbols {
+			if sym.Kind != KindBar {
+				continue
+			}
+			ref := SymbolRef{Stave: stavei, Symbol: symi}
+			starts, ends := startsRepeat(sym.Value), endsRepeat(sym.Value)
+
+			switch {
+			case ending != nil:
+				if sym.Volta != "" {
+					if !ends || starts {
+						return nil, fmt.Errorf("%v: irregular ending", sym.Pos)
+					}
+					ending.End = ref
+					open.Endings = append(open.Endings, *ending)
+					if err := startEnding(ref, sym.Volta); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if ends {
+					return nil, fmt.Errorf("%v: repeat at the end of the last ending", sym.Pos)
+				}
+				if starts || isSectionEnd(sym.Value) || sym.CloseVolta {
+					if err := finish(ref); err != nil {
+						return nil, err
+					}
+				}
+				if starts {
+					open = &Repeat{Start: ref}
+				}
+
+			case sym.Volta != "":
+				if ends || starts {
+					return nil, fmt.Errorf("%v: irregular ending", sym.Pos)
+				}
+				if open == nil {
+					open = &Repeat{Start: implicitStart}
+				}
+				open.End = ref
+				if err := startEnding(ref, sym.Volta); err != nil {
+					return nil, err
+				}
+
+			case ends:
+				if open == nil {
+					open = &Repeat{Start: implicitStart}
+				}
+				open.End = ref
+				if err := finish(ref); err != nil {
+					return nil, err
+				}
+				if starts {
+					open = &Repeat{Start: ref}
+				}
+
+			case starts:
+				if open != nil {
+					return nil, fmt.Errorf("%v: nested repeat", sym.Pos)
+				}
+				open = &Repeat{Start: ref}
+			}
+		}
+	}
+
+	if ending != nil {
+		if err := finish(SymbolRef{Stave: len(voice.Staves)}); err != nil {
+			return nil, err
+		}
+	}
+	if open != nil {
+		return nil, fmt.Errorf("unterminated repeat")
+	}
+	return repeats, nil
+}
+
+// checkEndings sets the number of times and checks that
+// every pass has exactly one ending.
+func (r *Repeat) checkEndings() error {
+	r.Times = 2
+	if len(r.Endings) == 0 {
+		return nil
+	}
+
+	used := map[int]bool{}
+	for _, ending := range r.Endings {
+		for _, n := range ending.Numbers {
+			if used[n] {
+				return fmt.Errorf("volta %d used multiple times", n)
+			}
+			used[n] = true
+		}
+	}
+	r.Times = len(used)
+	for n := 1; n <= r.Times; n++ {
+		if !used[n] {
+			return fmt.Errorf("missing volta %d", n)
+		}
+	}
+	return nil
+}
+
+// Consecutive returns whether the endings are numbered 1, 2, 3...
+func (r *Repeat) Consecutive() bool {
+	for i, ending := range r.Endings {
+		if len(ending.Numbers) != 1 || ending.Numbers[0] != i+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// VoltaString formats the volta numbers, e.g. "1,3".
+func (e Ending) VoltaString() string {
+	var s []string
+	for _, n := range e.Numbers {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func startsRepeat(bar string) bool { return strings.HasSuffix(bar, ":") }
+func endsRepeat(bar string) bool   { return strings.HasPrefix(bar, ":") }
+func isSectionEnd(bar string) bool {
+	return bar == "||" || bar == "|]" || bar == "[|"
+}
@@ -0,0 +1,85 @@
+package abc
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Tempo is the tempo specified by `Q:`, e.g. `Q:"Allegro" 1/4=120`.
+type Tempo struct {
+	// Text is the tempo description, e.g. "Allegro".
+	Text string
+	// Beats contains the note lengths that make up a single beat,
+	// e.g. [1/4 3/8] for `Q:1/4 3/8=40`.
+	Beats []big.Rat
+	// BPM is the number of beats per minute, 0 when not specified.
+	BPM int
+	// Relative is set for the legacy `Q:C=100` and `Q:100` forms,
+	// where the beat is the unit note length.
+	Relative bool
+}
+
+// ParseTempo parses the value of `Q:` field.
+func ParseTempo(s string) (Tempo, error) {
+	var tempo Tempo
+
+	var texts []string
+	for _, field := range splitFields(s) {
+		if strings.HasPrefix(field, `"`) {
+			texts = append(texts, strings.Trim(field, `"`))
+			continue
+		}
+
+		beats, bpm, hasBPM := strings.Cut(field, "=")
+		if !hasBPM {
+			// legacy `Q:120` or one of several beats, e.g. `Q:1/4 3/8=40`
+			if n, err := strconv.Atoi(field); err == nil {
+				tempo.BPM, tempo.Relative = n, true
+				continue
+			}
+			length, err := ParseNoteLength(field)
+			if err != nil {
+				return Tempo{}, fmt.Errorf("invalid tempo %q: %w", s, err)
+			}
+			tempo.Beats = append(tempo.Beats, length)
+			continue
+		}
+
+		switch {
+		case beats == "C" || beats == "c":
+			tempo.Relative = true
+		case beats != "":
+			length, err := ParseNoteLength(beats)
+			if err != nil {
+				return Tempo{}, fmt.Errorf("invalid tempo %q: %w", s, err)
+			}
+			tempo.Beats = append(tempo.Beats, length)
+		}
+
+		n, err := parsePositive(bpm)
+		if err != nil {
+			return Tempo{}, fmt.Errorf("invalid tempo %q: %w", s, err)
+		}
+		tempo.BPM = n
+	}
+	tempo.Text = strings.Join(texts, " ")
+
+	if tempo.BPM == 0 && (len(tempo.Beats) > 0 || tempo.Text == "") {
+		return Tempo{}, fmt.Errorf("invalid tempo %q", s)
+	}
+	return tempo, nil
+}
+
+// Beat returns the length of a single beat for the unit note length.
+func (tempo Tempo) Beat(unitNoteLength big.Rat) big.Rat {
+	if tempo.Relative || len(tempo.Beats) == 0 {
+		return *new(big.Rat).Set(&unitNoteLength)
+	}
+	var beat big.Rat
+	for i := range tempo.Beats {
+		beat.Add(&beat, &tempo.Beats[i])
+	}
+	return beat
+}
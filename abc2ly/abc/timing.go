@@ -0,0 +1,60 @@
+package abc
+
+import "math/big"
+
+// Timing tracks the meter and the unit note length while reading a tune.
+type Timing struct {
+	Meter          Meter
+	UnitNoteLength big.Rat
+
+	// explicit is set when the unit note length was specified with `L:`.
+	explicit bool
+}
+
+// NewTiming returns timing for meter with the default unit note length.
+func NewTiming(meter Meter) Timing {
+	return Timing{
+		Meter:          meter,
+		UnitNoteLength: DefaultUnitNoteLength(meter),
+	}
+}
+
+// SetMeter changes the meter, the default unit note length follows
+// the meter until the unit note length is set explicitly.
+func (t *Timing) SetMeter(meter Meter) {
+	t.Meter = meter
+	if !t.explicit {
+		t.UnitNoteLength = DefaultUnitNoteLength(meter)
+	}
+}
+
+// SetUnitNoteLength sets the unit note length specified by `L:`.
+func (t *Timing) SetUnitNoteLength(length big.Rat) {
+	t.UnitNoteLength = *new(big.Rat).Set(&length)
+	t.explicit = true
+}
+
+// DefaultUnitNoteLength returns the unit note length when `L:` is missing,
+// which is 1/16 when the meter is less than 0.75 and 1/8 otherwise.
+func DefaultUnitNoteLength(meter Meter) big.Rat {
+	if meter.Free || meter.BeatLength == 0 {
+		return *big.NewRat(1, 8)
+	}
+	if 4*meter.BeatsPerMeasure < 3*meter.BeatLength {
+		return *big.NewRat(1, 16)
+	}
+	return *big.NewRat(1, 8)
+}
+
+// Timing returns the timing at the start of the tune body.
+func (tune *Tune) Timing() (Timing, error) {
+	timing := NewTiming(tune.Meter)
+	if f, ok := tune.Field(FieldUnitNoteLength.Tag); ok {
+		length, err := ParseNoteLength(f.Value)
+		if err != nil {
+			return timing, err
+		}
+		timing.SetUnitNoteLength(length)
+	}
+	return timing, nil
+}
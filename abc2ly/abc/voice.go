@@ -0,0 +1,116 @@
+package abc
+
+import "strings"
+
+// Voice is a single part of a tune, e.g. `V:1 clef=bass name="Cello"`.
+type Voice struct {
+	ID      string
+	Name    string
+	Subname string
+	Clef    Clef
+
+	Staves []Stave
+}
+
+// DefineVoice finds or adds the voice described by the `V:` field value.
+// Properties in value override the previously defined ones, the clef
+// only changes while the voice has no music, see ParseVoiceClef.
+func (body *TuneBody) DefineVoice(value string) (*Voice, error) {
+	id, fields := voiceFields(value)
+
+	voice := body.Voice(id)
+	if voice == nil {
+		voice = &Voice{ID: id}
+		body.Voices = append(body.Voices, voice)
+	}
+
+	var clef Clef
+	for _, field := range fields {
+		if ok, err := clef.parseModifier(field); ok {
+			if err != nil {
+				return voice, err
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "name", "nm":
+			voice.Name = value
+		case "subname", "sname", "snm":
+			voice.Subname = value
+		}
+	}
+	if len(voice.Staves) == 0 {
+		voice.Clef = voice.Clef.With(clef)
+	}
+
+	return voice, nil
+}
+
+// ParseVoiceClef parses the clef modifiers of the `V:` field value.
+func ParseVoiceClef(value string) (Clef, error) {
+	_, fields := voiceFields(value)
+
+	var clef Clef
+	for _, field := range fields {
+		if _, err := clef.parseModifier(field); err != nil {
+			return clef, err
+		}
+	}
+	return clef, nil
+}
+
+// voiceFields splits the `V:` field value into the voice id and the properties.
+func voiceFields(value string) (id string, fields []string) {
+	fields = splitFields(value)
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		id, fields = fields[0], fields[1:]
+	}
+	return id, fields
+}
+
+// Voice finds the voice with the specified id.
+func (body *TuneBody) Voice(id string) *Voice {
+	for _, voice := range body.Voices {
+		if voice.ID == id {
+			return voice
+		}
+	}
+	return nil
+}
+
+// splitFields splits s by whitespace, keeping quoted strings intact.
+func splitFields(s string) []string {
+	var fields []string
+
+	quoted := false
+	start := -1
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case !quoted && (r == ' ' || r == '\t'):
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+
+	return fields
+}
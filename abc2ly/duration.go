@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/egonelbre/lilypond/abc2ly/abc"
+)
+
+// writableDurations contains durations that LilyPond can write
+// as a single note with up to three dots, longest first.
+var writableDurations = func() []big.Rat {
+	var durations []big.Rat
+	for k := int64(0); k <= 7; k++ {
+		for dots := int64(3); dots >= 0; dots-- {
+			// base * (2 - 1/2^dots)
+			durations = append(durations, *big.NewRat(2<<dots-1, 1<<(k+dots)))
+		}
+	}
+	return durations
+}()
+
+// isWritable returns whether dur can be written as a single note.
+func isWritable(dur big.Rat) bool {
+	for i := range writableDurations {
+		if writableDurations[i].Cmp(&dur) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isPowerOfTwo returns whether the denominator of dur is a power of two.
+func isPowerOfTwo(dur big.Rat) bool {
+	d := dur.Denom()
+	return new(big.Int).And(d, new(big.Int).Sub(d, big.NewInt(1))).Sign() == 0
+}
+
+// largestWritable returns the longest writable duration that fits into dur.
+func largestWritable(dur big.Rat) (big.Rat, bool) {
+	for i := range writableDurations {
+		if writableDurations[i].Cmp(&dur) <= 0 {
+			return writableDurations[i], true
+		}
+	}
+	return big.Rat{}, false
+}
+
+// largestWritableOnBeat returns the longest writable duration that fits
+// into limit and ends on a beat or completes the note.
+func largestWritableOnBeat(limit, remaining, offset big.Rat, beats []big.Rat) (big.Rat, bool) {
+	for i := range writableDurations {
+		piece := &writableDurations[i]
+		if piece.Cmp(&limit) > 0 {
+			continue
+		}
+		if piece.Cmp(&remaining) == 0 || beats == nil {
+			return *piece, true
+		}
+		end := new(big.Rat).Add(&offset, piece)
+		for k := range beats {
+			if beats[k].Cmp(end) == 0 {
+				return *piece, true
+			}
+		}
+	}
+	return largestWritable(limit)
+}
+
+// splitDuration splits dur starting at offset from the start of the measure
+// into durations that can be written as tied notes. Notes are split at
+// measure boundaries and, when they do not fit a single note, at beats.
+func splitDuration(dur, offset big.Rat, meter abc.Meter) []big.Rat {
+	if dur.Sign() <= 0 || !isPowerOfTwo(dur) {
+		return []big.Rat{dur}
+	}
+	if meter.Free || meter.BeatLength == 0 {
+		return splitBeats(dur, offset, nil)
+	}
+
+	measure := big.NewRat(int64(meter.BeatsPerMeasure), int64(meter.BeatLength))
+	offset = *new(big.Rat).Set(&offset)
+	for offset.Cmp(measure) >= 0 {
+		offset.Sub(&offset, measure)
+	}
+
+	beats := beatOffsets(meter)
+	var pieces []big.Rat
+	remaining := *new(big.Rat).Set(&dur)
+	for remaining.Sign() > 0 {
+		segment := *new(big.Rat).Sub(measure, &offset)
+		if remaining.Cmp(&segment) < 0 {
+			segment.Set(&remaining)
+		}
+		if isWritable(segment) {
+			pieces = append(pieces, segment)
+		} else {
+			pieces = append(pieces, splitBeats(segment, offset, beats)...)
+		}
+		remaining.Sub(&remaining, &segment)
+		offset.SetInt64(0)
+	}
+	return pieces
+}
+
+// splitBeats splits dur starting at offset into writable durations,
+// a note starting between beats is first split at the next beat.
+func splitBeats(dur, offset big.Rat, beats []big.Rat) []big.Rat {
+	var pieces []big.Rat
+	remaining := *new(big.Rat).Set(&dur)
+	offset = *new(big.Rat).Set(&offset)
+	for remaining.Sign() > 0 {
+		limit := *new(big.Rat).Set(&remaining)
+		if next, ok := nextBeat(offset, beats); ok {
+			untilBeat := *new(big.Rat).Sub(&next, &offset)
+			if untilBeat.Cmp(&limit) < 0 {
+				limit = untilBeat
+			}
+		}
+
+		piece, ok := largestWritableOnBeat(limit, remaining, offset, beats)
+		if !ok {
+			return append(pieces, remaining)
+		}
+		pieces = append(pieces, piece)
+		remaining.Sub(&remaining, &piece)
+		offset.Add(&offset, &piece)
+	}
+	return pieces
+}
+
+// nextBeat returns the next beat after offset, when offset is not on a beat.
+func nextBeat(offset big.Rat, beats []big.Rat) (big.Rat, bool) {
+	for i := range beats {
+		switch beats[i].Cmp(&offset) {
+		case 0:
+			return big.Rat{}, false
+		case 1:
+			return beats[i], true
+		}
+	}
+	return big.Rat{}, false
+}
+
+// beatOffsets returns the start of every beat in a measure.
+func beatOffsets(meter abc.Meter) []big.Rat {
+	var lengths []int64
+	switch {
+	case len(meter.Groups) > 0:
+		for _, n := range meter.Groups {
+			lengths = append(lengths, int64(n))
+		}
+	case meter.IsCompound():
+		for range iter(meter.BeatsPerMeasure / 3) {
+			lengths = append(lengths, 3)
+		}
+	default:
+		for range iter(meter.BeatsPerMeasure) {
+			lengths = append(lengths, 1)
+		}
+	}
+
+	var offsets []big.Rat
+	var offset big.Rat
+	for _, n := range lengths {
+		offsets = append(offsets, *new(big.Rat).Set(&offset))
+		offset.Add(&offset, big.NewRat(n, int64(meter.BeatLength)))
+	}
+	return append(offsets, offset)
+}
+
+// durationToString converts a writable duration to LilyPond duration.
+func durationToString(dur big.Rat) (string, error) {
+	num := dur.Num().Int64()
+	denom := dur.Denom().Int64()
+
+	switch num {
+	case 1:
+		return strconv.Itoa(int(denom)), nil
+	case 3:
+		return strconv.Itoa(int(denom/2)) + ".", nil
+	case 7:
+		return strconv.Itoa(int(denom/4)) + "..", nil
+	case 15:
+		return strconv.Itoa(int(denom/8)) + "...", nil
+	}
+
+	return "", fmt.Errorf("unhandled duration %v", dur.RatString())
+}
+
+// scaledDuration converts dur to LilyPond duration, using a scaled
+// duration when there is no single note for it.
+func scaledDuration(dur big.Rat) string {
+	if isWritable(dur) {
+		if s, err := durationToString(dur); err == nil {
+			return s
+		}
+	}
+	return "1*" + dur.RatString()
+}
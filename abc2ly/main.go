@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,9 +18,17 @@ import (
 	"golang.org/x/exp/slices"
 )
 
+// setRepeatCommandIly defines \setRepeatCommand used for irregular repeats.
+//
+//go:embed set-repeat-command.ily
+var setRepeatCommandIly string
+
 func main() {
 	filePerTune := flag.Bool("file-per-tune", false, "creates a single file per tune")
 	outdir := flag.String("out", "", "output directory")
+	appoggiatura := flag.Bool("appoggiatura", false, "render unslashed grace notes as appoggiaturas")
+	midi := flag.Bool("midi", false, "add MIDI output to the scores")
+	unfoldParts := flag.Bool("unfold-parts", false, "write the parts in playing order")
 	flag.Parse()
 
 	if *filePerTune && *outdir == "" {
@@ -36,24 +46,49 @@ func main() {
 
 	fmt.Fprintln(os.Stderr, "Parsed", len(book.Tunes), "tunes")
 	for _, warning := range warnings {
-		fmt.Fprintln(os.Stderr, "\t", warning.Message)
+		fmt.Fprintf(os.Stderr, "%s:%v\n", flag.Arg(0), warning)
+	}
+
+	warn := func(err error) {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", flag.Arg(0), err)
 	}
 
+	var failed []error
+
 	if *filePerTune {
 		paths := []string{}
 
 		os.MkdirAll(*outdir, 0755)
 
+		repeatCommandWritten := false
 		for _, tune := range book.Tunes {
 			if tune.ID == "" {
 				// TODO: handle this better
 				continue
 			}
+			score := &bytes.Buffer{}
+			c := Convert{Output: score, Appoggiatura: *appoggiatura, MIDI: *midi, UnfoldParts: *unfoldParts, Warn: warn}
+			if err := c.Tune(tune); err != nil {
+				failed = append(failed, err)
+				continue
+			}
+
 			out := &bytes.Buffer{}
-			c := Convert{Output: out}
-			c.pf(`\version "2.24.0"` + "\n")
-			//c.pf("\\include \"set-repeat-command.ily\"\n")
-			c.Tune(tune)
+			fmt.Fprintln(out, `\version "2.24.0"`)
+			// the definition is only needed for irregular repeats
+			if usesRepeatCommand(score.Bytes()) {
+				if !repeatCommandWritten {
+					err := os.WriteFile(filepath.Join(*outdir, "set-repeat-command.ily"), []byte(withoutVersion(setRepeatCommandIly)+"\n"), 0o644)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						os.Exit(1)
+					}
+					repeatCommandWritten = true
+				}
+				fmt.Fprintln(out, `\include "set-repeat-command.ily"`)
+			}
+			_, _ = out.Write(score.Bytes())
+
 			p := filepath.Join(*outdir, tune.ID+".ly")
 			err := os.WriteFile(p, out.Bytes(), 0o644)
 			if err != nil {
@@ -68,84 +103,534 @@ func main() {
 			fmt.Fprintf(main, "\\include %q\n", p)
 		}
 
-		err := os.WriteFile(filepath.Join(*outdir, "_index.ly"), main.Bytes(), 0644)
+		err = os.WriteFile(filepath.Join(*outdir, "_index.ly"), main.Bytes(), 0644)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 	} else {
-		c := Convert{Output: os.Stdout}
-		c.pf(`\version "2.24.0"` + "\n")
-		//c.pf("\\include \"set-repeat-command.ily\"\n")
+		scores := &bytes.Buffer{}
+		c := Convert{Output: scores, Appoggiatura: *appoggiatura, MIDI: *midi, UnfoldParts: *unfoldParts, Warn: warn}
 		for _, tune := range book.Tunes {
-			c.Tune(tune)
+			if err := c.Tune(tune); err != nil {
+				failed = append(failed, err)
+			}
+		}
+
+		fmt.Fprintln(os.Stdout, `\version "2.24.0"`)
+		// the definition is only needed for irregular repeats
+		if usesRepeatCommand(scores.Bytes()) {
+			fmt.Fprintf(os.Stdout, "%s\n\n", withoutVersion(setRepeatCommandIly))
 		}
+		_, _ = os.Stdout.Write(scores.Bytes())
 	}
+
+	if len(failed) > 0 {
+		fmt.Fprintln(os.Stderr, "Failed to convert", len(failed), "tunes")
+		for _, err := range failed {
+			fmt.Fprintf(os.Stderr, "%s:%v\n", flag.Arg(0), err)
+		}
+		os.Exit(1)
+	}
+}
+
+// usesRepeatCommand returns whether the converted scores use \setRepeatCommand.
+func usesRepeatCommand(scores []byte) bool {
+	return bytes.Contains(scores, []byte(`\setRepeatCommand`))
+}
+
+// withoutVersion removes the \version statement from LilyPond source.
+func withoutVersion(source string) string {
+	var lines []string
+	for _, line := range strings.Split(source, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), `\version`) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
 }
 
 type Convert struct {
 	Output io.Writer
+
+	// Appoggiatura renders unslashed grace notes as \appoggiatura instead of \grace.
+	Appoggiatura bool
+	// MIDI adds \midi block to the scores.
+	MIDI bool
+	// UnfoldParts writes the parts in the playing order from `P:`.
+	UnfoldParts bool
+	// Warn is called for symbols that are converted approximately.
+	Warn func(err error)
 }
 
 func (c *Convert) pf(format string, args ...any) {
 	_, _ = fmt.Fprintf(c.Output, format, args...)
 }
 
-func (c *Convert) Tune(tune *abc.Tune) {
-	c.Score(tune)
+// Error is a failure to convert a tune.
+type Error struct {
+	TuneID string
+	Pos    abc.Pos
+	Err    error
 }
 
-func (c *Convert) Score(tune *abc.Tune) {
+func (err *Error) Error() string {
+	return fmt.Sprintf("%v: tune %q: %v", err.Pos, err.TuneID, err.Err)
+}
+
+func (err *Error) Unwrap() error { return err.Err }
+
+func errorf(tune *abc.Tune, pos abc.Pos, format string, args ...any) error {
+	return &Error{
+		TuneID: tune.ID,
+		Pos:    pos,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+// warnf reports an approximate conversion.
+func (c *Convert) warnf(tune *abc.Tune, pos abc.Pos, format string, args ...any) {
+	if c.Warn != nil {
+		c.Warn(errorf(tune, pos, format, args...))
+	}
+}
+
+// Tune converts a single tune. Nothing is written to the output
+// when the conversion fails.
+func (c *Convert) Tune(tune *abc.Tune) error {
+	if tune.Failed {
+		return errorf(tune, tune.Pos, "failed to parse")
+	}
+
+	var out bytes.Buffer
+	score := *c
+	score.Output = &out
+	if err := score.Score(tune); err != nil {
+		return err
+	}
+
+	_, err := c.Output.Write(out.Bytes())
+	return err
+}
+
+func (c *Convert) Score(tune *abc.Tune) error {
 	c.pf("\\score {\n")
 	defer c.pf("}\n")
 
 	c.Header(tune)
 
-	c.pf("  \\new Staff{\n")
+	if c.UnfoldParts {
+		tune = tune.Unfold()
+	}
+	voices := voices(tune)
+
+	staves := make([]bytes.Buffer, len(voices))
+	music := make([]staffMusic, len(voices))
+	simultaneous := len(voices) > 1 || hasLyrics(voices)
+	for i, voice := range voices {
+		staff := *c
+		staff.Output = &staves[i]
+		var err error
+		music[i], err = staff.Staff(tune, voice, "voice"+strconv.Itoa(i+1))
+		if err != nil {
+			return err
+		}
+		if len(music[i].chords.events) > 0 {
+			simultaneous = true
+		}
+	}
+
+	if c.MIDI {
+		defer c.pf("  \\layout { }\n  \\midi { }\n")
+	}
+	if simultaneous {
+		c.pf("  <<\n")
+		defer c.pf("  >>\n")
+	}
+	for i, voice := range voices {
+		c.ChordNames(music[i].chords)
+		_, _ = c.Output.Write(staves[i].Bytes())
+		c.Lyrics(voice, "voice"+strconv.Itoa(i+1), music[i].pieces)
+	}
+	return nil
+}
+
+// defaultVoice is used for tunes without music.
+var defaultVoice = &abc.Voice{}
+
+// voices returns the voices of the tune.
+func voices(tune *abc.Tune) []*abc.Voice {
+	if len(tune.Body.Voices) == 0 {
+		return []*abc.Voice{defaultVoice}
+	}
+	return tune.Body.Voices
+}
+
+// staffMusic contains the music of a staff needed by the other contexts.
+type staffMusic struct {
+	chords chordNames
+	// pieces contains the number of tied notes every note of a stave
+	// was split into.
+	pieces [][]int
+}
+
+// chordNames contains chord symbols of a single voice.
+type chordNames struct {
+	events []chordEvent
+	length big.Rat
+}
+
+type chordEvent struct {
+	pos   big.Rat
+	stave int
+	chord *abc.Chord
+}
+
+// ChordNames writes chord symbols as a ChordNames context.
+func (c *Convert) ChordNames(chords chordNames) {
+	if len(chords.events) == 0 {
+		return
+	}
+
+	c.pf("  \\new ChordNames \\chordmode {\n")
+	defer c.pf("  }\n")
+
+	c.pf("   ")
+	first := chords.events[0]
+	if first.pos.Sign() > 0 {
+		c.pf(" s%s", scaledDuration(first.pos))
+	}
+	for i, ev := range chords.events {
+		end := chords.length
+		if i+1 < len(chords.events) {
+			end = chords.events[i+1].pos
+		}
+		var dur big.Rat
+		dur.Sub(&end, &ev.pos)
+		if dur.Sign() <= 0 {
+			continue
+		}
+		if i > 0 && chords.events[i-1].stave != ev.stave {
+			c.pf("\n   ")
+		}
+		c.pf(" %s", chordToString(ev.chord, scaledDuration(dur)))
+	}
+	c.pf("\n")
+}
+
+// chordToString converts chord to LilyPond chordmode.
+func chordToString(chord *abc.Chord, dur string) string {
+	if chord.NoChord() {
+		return "r" + dur
+	}
+
+	var main string
+	var steps []string
+	var sus string
+	for _, ext := range chord.Extensions {
+		switch {
+		case strings.HasPrefix(ext, "maj"):
+			main = ext
+		case strings.HasPrefix(ext, "sus"):
+			sus = ext
+		case strings.HasPrefix(ext, "add"):
+			steps = append(steps, strings.TrimPrefix(ext, "add"))
+		case strings.HasPrefix(ext, "b"):
+			steps = append(steps, ext[1:]+"-")
+		case strings.HasPrefix(ext, "#"):
+			steps = append(steps, ext[1:]+"+")
+		default:
+			main = ext
+		}
+	}
+	if main == "" && len(steps) > 0 {
+		main = "5"
+	}
+	if chord.Quality == "m" && strings.HasPrefix(main, "maj") {
+		// minor-major chords raise the seventh, e.g. "m7+" or "m9.7+"
+		if n := strings.TrimPrefix(main, "maj"); n == "7" {
+			main = "7+"
+		} else {
+			main = n + ".7+"
+		}
+	}
+
+	modifiers := chord.Quality + main
+	if len(steps) > 0 {
+		modifiers += "." + strings.Join(steps, ".")
+	}
+	modifiers += sus
+
+	s := chordNoteToPitch(chord.Root) + dur
+	if modifiers != "" {
+		s += ":" + modifiers
+	}
+	if chord.Bass != "" {
+		s += "/" + chordNoteToPitch(chord.Bass)
+	}
+	return s
+}
+
+// chordNoteToPitch converts chord note name, e.g. "Bb" to LilyPond pitch "bes".
+func chordNoteToPitch(note string) string {
+	pitch := strings.ToLower(note[:1])
+	switch note[1:] {
+	case "b":
+		pitch += "es"
+	case "#":
+		pitch += "is"
+	}
+	return pitch
+}
+
+func hasLyrics(voices []*abc.Voice) bool {
+	for _, voice := range voices {
+		if verseCount(voice) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func verseCount(voice *abc.Voice) int {
+	count := 0
+	for _, stave := range voice.Staves {
+		if len(stave.Lyrics) > count {
+			count = len(stave.Lyrics)
+		}
+	}
+	return count
+}
+
+// Lyrics writes a Lyrics context for every verse of the voice,
+// pieces is the number of tied notes every note was split into.
+func (c *Convert) Lyrics(voice *abc.Voice, name string, pieces [][]int) {
+	verses := verseCount(voice)
+	for verse := 0; verse < verses; verse++ {
+		c.pf("  \\new Lyrics \\lyricsto %q {\n", name)
+		// every note gets a syllable, as in ABC
+		c.pf("    \\set ignoreMelismata = ##t\n")
+		for stavei, stave := range voice.Staves {
+			var syllables []abc.Syllable
+			if verse < len(stave.Lyrics) {
+				syllables = stave.Lyrics[verse]
+			} else {
+				for _, sym := range stave.Symbols {
+					if sym.Kind == abc.KindNote {
+						syllables = append(syllables, abc.Syllable{})
+					}
+				}
+			}
+			if len(syllables) == 0 {
+				continue
+			}
+
+			c.pf("   ")
+			for i, syl := range syllables {
+				c.pf(" %s", syllableToString(syl.Text))
+				if syl.Hyphen {
+					c.pf(" --")
+				}
+				if syl.Extend {
+					c.pf(" __")
+				}
+				// notes split into tied notes take a single syllable
+				if stavei < len(pieces) && i < len(pieces[stavei]) {
+					for range iter(pieces[stavei][i] - 1) {
+						c.pf(" _")
+					}
+				}
+			}
+			c.pf("\n")
+		}
+		c.pf("  }\n")
+	}
+}
+
+func syllableToString(text string) string {
+	if text == "" {
+		return "_"
+	}
+	if strings.ContainsAny(text, " \t{}\\\"#0123456789_~") || strings.HasPrefix(text, "-") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+func (c *Convert) Staff(tune *abc.Tune, voice *abc.Voice, name string) (music staffMusic, err error) {
+	clef := tune.Key.Clef.With(voice.Clef)
+	clefPos := tune.Pos
+	if k, ok := tune.Field(abc.FieldKey.Tag); ok {
+		clefPos = k.Pos
+	}
+
+	c.pf("  \\new Staff")
+	if voice.Name != "" || voice.Subname != "" || clef.StaffLines != 0 {
+		c.pf(" \\with {")
+		if voice.Name != "" {
+			c.pf(" instrumentName = %q", voice.Name)
+		}
+		if voice.Subname != "" {
+			c.pf(" shortInstrumentName = %q", voice.Subname)
+		}
+		if clef.StaffLines != 0 {
+			c.pf(" \\override StaffSymbol.line-count = #%d", clef.StaffLines)
+		}
+		c.pf(" }")
+	}
+	if verseCount(voice) > 0 {
+		c.pf(" \\new Voice = %q", name)
+	}
+	c.pf("{\n")
 	defer c.pf("  }\n")
 
-	if meter, ok := tune.Fields.ByTag(abc.FieldMeter.Tag); ok {
-		c.pf("    \\time %v", meter.Value)
+	c.pf("   ")
+	if err := c.clef(clef); err != nil {
+		return music, errorf(tune, clefPos, "%w", err)
+	}
+	octaveOffset, err := clefOctaveOffset(clef)
+	if err != nil {
+		return music, errorf(tune, clefPos, "%w", err)
+	}
+	var timeSig timeSignature
+	if _, ok := tune.Field(abc.FieldMeter.Tag); ok {
+		c.pf("%s", timeSig.change(tune.Meter))
 	}
 
-	noteLength := *big.NewRat(1, 4)
-	if f, ok := tune.Fields.ByTag(abc.FieldUnitNoteLength.Tag); ok {
-		noteLength = abc.ParseNoteLength(f.Value)
+	timing, err := tune.Timing()
+	if err != nil {
+		f, _ := tune.Field(abc.FieldUnitNoteLength.Tag)
+		return music, errorf(tune, f.Pos, "%w", err)
 	}
+	noteLength := timing.UnitNoteLength
 
 	insideRepeat, insideVolta := false, false
 
-	keySignature, octaveOffset := map[string]string{}, 1
-	if k, ok := tune.Fields.ByTag(abc.FieldKey.Tag); ok {
-		var key string
-		key, keySignature, octaveOffset = parseKeySignature(k.Value, octaveOffset)
-		decl, ok := abcKeySignatureToLilypond[key]
-		if !ok {
-			panic("unhandled signature " + key)
+	keySignature := map[string]string{}
+	if tune.Key.HasSignature() {
+		keySignature = keyAccidentals(tune.Key)
+		c.pf(" %s", keyToLilypond(tune.Key))
+	}
+	// tempo marks apply to the whole score
+	if q, ok := tune.Field(abc.FieldTempo.Tag); ok && voice == voices(tune)[0] {
+		if err := c.tempo(tune, q.Pos, q.Value, noteLength); err != nil {
+			return music, err
 		}
-		c.pf(" %s", decl)
 	}
 
-	var lastSym abc.Symbol
+	// changeClef applies the clef modifiers of `K:` or `V:` field
+	changeClef := func(next abc.Clef) error {
+		clef = clef.With(next)
+		if next.StaffLines != 0 {
+			c.pf(" \\stopStaff \\override Staff.StaffSymbol.line-count = #%d \\startStaff", next.StaffLines)
+		}
+		if err := c.clef(next); err != nil {
+			return err
+		}
+		var err error
+		octaveOffset, err = clefOctaveOffset(clef)
+		return err
+	}
+
 	barAccidentals := maps.Clone(keySignature)
 	tiedNotePitch := ""
 
+	slurDepth := 0
+	// hairpin is set while a crescendo or diminuendo is open
+	hairpin := false
+
+	// pos is the position from the start of the tune
+	var pos big.Rat
+	defer func() { music.chords.length = pos }()
+	// measurePos is the position from the last bar
+	var measurePos big.Rat
+
+	// tuplet is closed lazily, because decorations follow the last note
+	insideTuplet, tupletRemaining := false, 0
+	var tupletRatio big.Rat
+	advance := func(dur big.Rat) {
+		if insideTuplet {
+			dur.Mul(&dur, &tupletRatio)
+		}
+		pos.Add(&pos, &dur)
+		measurePos.Add(&measurePos, &dur)
+	}
+	// split splits the duration into pieces that can be written as single notes
+	split := func(dur big.Rat) []big.Rat {
+		if insideTuplet {
+			return splitDuration(dur, big.Rat{}, abc.Meter{Free: true})
+		}
+		return splitDuration(dur, measurePos, timing.Meter)
+	}
+	// tail contains the remaining pieces of the last note, it's written
+	// lazily, because decorations attach to the first piece
+	tail := ""
+	flushTail := func() {
+		c.pf("%s", tail)
+		tail = ""
+	}
+	closeTuplet := func(force bool) {
+		if insideTuplet && (force || tupletRemaining <= 0) {
+			c.pf(" }")
+			insideTuplet = false
+		}
+	}
+
+	// irregular repeats fall back to \setRepeatCommand
+	var repeatBars map[abc.SymbolRef]string
+	if repeats, err := abc.AnalyzeRepeats(voice); err == nil {
+		repeatBars = repeatCommands(repeats)
+	}
+	// navigation marks are written by \repeat segno when it can be inferred
+	segnoRepeat := false
+	if nav, err := abc.AnalyzeNavigation(voice); err != nil {
+		// the jump is still written as text
+		var navErr *abc.NavigationError
+		if errors.As(err, &navErr) {
+			c.warnf(tune, navErr.Pos, "%v", navErr.Err)
+		}
+	} else if len(repeatBars) == 0 {
+		if bars, ok := segnoCommands(voice, nav); ok {
+			repeatBars, segnoRepeat = bars, true
+		}
+	}
+	segnoCount, codaCount := 0, 0
+
 	c.pf("\n")
-	for stavei, stave := range tune.Body.Staves {
+	for stavei, stave := range voice.Staves {
 		if stavei > 0 {
 			c.pf(" \\break\n")
 		}
 		c.pf("   ")
+		c.pf("%s", repeatBars[abc.SymbolRef{Stave: stavei, Symbol: -1}])
 
 		symbols := slices.Clone(stave.Symbols)
+		var notePieces []int
 
-		// sort notes before decorations and texts
+		// sort notes before decorations, texts and slurs,
+		// tuplets stay before the note, e.g. `((3ABc)`
 		for i := len(symbols) - 1; i >= 0; i-- {
 			if symbols[i].Kind == abc.KindNote || symbols[i].Kind == abc.KindRest {
-				p := i - 1
-				for p >= 0 && (symbols[p].Kind == abc.KindDeco || symbols[p].Kind == abc.KindText) {
-					symbols[p], symbols[p+1] = symbols[p+1], symbols[p]
+				start := i
+				for start > 0 && (isPostfix(symbols[start-1]) || symbols[start-1].Kind == abc.KindTuplet) {
+					start--
+				}
+				run := slices.Clone(symbols[start:i])
+				k := start
+				for _, sym := range run {
+					if sym.Kind == abc.KindTuplet {
+						symbols[k] = sym
+						k++
+					}
+				}
+				symbols[k] = symbols[i]
+				k++
+				for _, sym := range run {
+					if sym.Kind != abc.KindTuplet {
+						symbols[k] = sym
+						k++
+					}
 				}
-				i = p + 1
+				i = start
 			}
 		}
 
@@ -153,69 +638,67 @@ func (c *Convert) Score(tune *abc.Tune) {
 			var nextSym abc.Symbol
 			if symi+1 < len(symbols) {
 				nextSym = symbols[symi+1]
-			} else if stavei+1 < len(tune.Body.Staves) {
-				nextSym = tune.Body.Staves[stavei+1].Symbols[0]
+			} else if stavei+1 < len(voice.Staves) {
+				nextSym = voice.Staves[stavei+1].Symbols[0]
+			}
+
+			if !isPostfix(sym) {
+				flushTail()
+				if sym.Kind != abc.KindSlurEnd {
+					closeTuplet(sym.Kind == abc.KindTuplet)
+				}
 			}
 
 			switch sym.Kind {
 			case abc.KindText:
-				c.pf(" ^%q", sym.Value)
+				switch sym.Annotation.Placement {
+				case abc.PlaceLeft, abc.PlaceRight:
+					c.warnf(tune, sym.Pos, "annotation %q is placed above the note", sym.Value)
+				}
+				c.pf(" %s", annotationToString(sym.Annotation))
+			case abc.KindChord:
+				music.chords.events = append(music.chords.events, chordEvent{
+					pos:   *new(big.Rat).Set(&pos),
+					stave: stavei,
+					chord: sym.Chord,
+				})
+			case abc.KindTuplet:
+				c.pf(" \\tuplet %d/%d {", sym.Tuplet.P, sym.Tuplet.Q)
+				insideTuplet, tupletRemaining = true, sym.Tuplet.R
+				tupletRatio.SetFrac64(int64(sym.Tuplet.Q), int64(sym.Tuplet.P))
+			case abc.KindSlurStart:
+				slurDepth++
+				if slurDepth == 1 {
+					c.pf("(")
+				} else {
+					c.pf("\\=%d(", slurDepth)
+				}
+			case abc.KindSlurEnd:
+				if slurDepth == 0 {
+					break
+				}
+				if slurDepth == 1 {
+					c.pf(")")
+				} else {
+					c.pf("\\=%d)", slurDepth)
+				}
+				slurDepth--
 			case abc.KindNote:
-				dur := calculateDuration(&noteLength, &sym, &lastSym)
+				tupletRemaining--
+				dur := *new(big.Rat).Mul(&noteLength, &sym.Duration)
 
 				var notePitch string
 				if tiedNotePitch != "" {
 					notePitch = tiedNotePitch
 					tiedNotePitch = ""
 				} else {
-					var notes []string
-					nextAccidentals := map[string]string{}
-					for _, note := range sym.Notes {
-						n := note.Pitch
-						if note.Accidentals != "" {
-							suffix := ""
-							for _, acc := range note.Accidentals {
-								switch acc {
-								case abc.AccidentalFlat:
-									suffix += "es"
-								case abc.AccidentalSharp:
-									suffix += "is"
-								case abc.AccidentalNatural:
-									suffix = ""
-								}
-							}
-							n += suffix
-							nextAccidentals[note.PitchOctave()] = suffix
-						} else {
-							if localSuffix, ok := barAccidentals[note.PitchOctave()]; ok {
-								n += localSuffix
-							} else if keySuffix, ok := barAccidentals[note.Pitch]; ok {
-								n += keySuffix
-							}
-						}
-
-						oct := note.Octave + octaveOffset
-						for range iter(oct) {
-							n += "'"
-						}
-						for range iter(-oct) {
-							n += ","
-						}
-
-						notes = append(notes, n)
-					}
+					var nextAccidentals map[string]string
+					notePitch, nextAccidentals = pitchToString(sym.Notes, barAccidentals, octaveOffset)
 					for k, v := range nextAccidentals {
 						barAccidentals[k] = v
 					}
-
-					switch {
-					case len(notes) > 1:
-						notePitch = "<" + strings.Join(notes, " ") + ">"
-					case len(notes) == 1:
-						notePitch = notes[0]
-					default:
-						fmt.Printf("\n\n%#v\n\n", sym)
-						panic("invalid notes")
+					if notePitch == "" {
+						return music, errorf(tune, sym.Pos, "invalid notes")
 					}
 				}
 
@@ -225,34 +708,92 @@ func (c *Convert) Score(tune *abc.Tune) {
 					tiedNotePitch = notePitch
 				}
 
-				c.pf(" %s%s%s", notePitch, durationToString(dur), tie)
+				if startsDottedSlur(symbols[symi+1:]) {
+					c.pf(" \\once \\slurDotted")
+				}
+				if sym.Grace != nil {
+					c.grace(sym.Grace, &noteLength, barAccidentals, octaveOffset)
+				}
+				pieces := split(dur)
+				notePieces = append(notePieces, len(pieces))
+				c.pf(" %s%s", notePitch, scaledDuration(pieces[0]))
+				for _, piece := range pieces[1:] {
+					tail += fmt.Sprintf("~ %s%s", notePitch, scaledDuration(piece))
+				}
+				tail += tie
+				advance(dur)
 
 			case abc.KindRest:
+				if sym.Value != "y" {
+					tupletRemaining--
+				}
 				tiedNotePitch = ""
-				dur := calculateDuration(&noteLength, &sym, &lastSym)
+				dur := *new(big.Rat).Mul(&noteLength, &sym.Duration)
+
+				// rest splits into separate rests
+				rest := func(value string) {
+					pieces := split(dur)
+					c.pf(" %s%s", value, scaledDuration(pieces[0]))
+					for _, piece := range pieces[1:] {
+						tail += fmt.Sprintf(" %s%s", value, scaledDuration(piece))
+					}
+					advance(dur)
+				}
 
-				value := ""
 				switch sym.Value {
 				case "z":
-					value = "r"
-					c.pf(" %s%s", value, durationToString(dur))
-				case "Z": // this should be full bar rest
-					value = "r"
-					dur.Mul(&dur, big.NewRat(2, 1)) // TODO: handle correctly
-					c.pf(" %s%s", value, durationToString(dur))
+					rest("r")
+				case "x":
+					rest("s")
 				case "y":
+					if dur.Sign() > 0 {
+						rest("s")
+					}
+				case "Z", "X":
+					measures := int(sym.Duration.Num().Int64())
+					if !sym.Duration.IsInt() {
+						return music, errorf(tune, sym.Pos, "invalid number of measures %v", sym.Duration.RatString())
+					}
+					if timing.Meter.BeatLength == 0 {
+						return music, errorf(tune, sym.Pos, "multi-measure rest without a meter")
+					}
+					measure := *big.NewRat(int64(timing.Meter.BeatsPerMeasure), int64(timing.Meter.BeatLength))
+					if sym.Value == "X" {
+						c.pf(" s%s", measureDuration(measure, measures))
+					} else {
+						c.pf(" \\compressMMRests { R%s }", measureDuration(measure, measures))
+					}
+					for range iter(measures) {
+						advance(measure)
+					}
 				default:
-					panic("unhandled rest " + sym.Value + " tune:" + tune.ID)
+					return music, errorf(tune, sym.Pos, "unhandled rest %q", sym.Value)
 				}
 
 			case abc.KindBar:
 				barAccidentals = maps.Clone(keySignature)
+				measurePos.SetInt64(0)
+
+				if text, ok := repeatBars[abc.SymbolRef{Stave: stavei, Symbol: symi}]; ok {
+					c.pf("%s", text)
+					switch sym.Value {
+					case "||":
+						c.pf(` \bar "||"`)
+					case "|]":
+						c.pf(` \bar "|."`)
+					}
+					break
+				}
 
 				// TODO: handle volta
 
 				switch sym.Value {
 				case "|":
-					c.pf(` |`)
+					if timeSig.meter.Free {
+						c.pf(` \bar "|"`)
+					} else {
+						c.pf(` |`)
+					}
 					if sym.CloseVolta {
 						c.pf(` \setRepeatCommand ##f`)
 						insideVolta = false
@@ -277,14 +818,14 @@ func (c *Convert) Score(tune *abc.Tune) {
 					}
 				case "|]":
 					if insideRepeat {
-						panic("still in repeat")
+						return music, errorf(tune, sym.Pos, "still in repeat")
 					}
 					if insideVolta || sym.CloseVolta {
 						c.pf(` \setRepeatCommand ##f`)
 						insideVolta = false
 					}
 					if sym.Volta != "" {
-						panic("did not expect volta on |]")
+						return music, errorf(tune, sym.Pos, "did not expect volta on |]")
 					}
 					c.pf(` \bar "|."`)
 				case "::", ":|:", ":||:":
@@ -332,188 +873,565 @@ func (c *Convert) Score(tune *abc.Tune) {
 					}
 
 				default:
-					panic("unhandled bar " + sym.Value + " tune:" + tune.ID)
+					return music, errorf(tune, sym.Pos, "unhandled bar %q", sym.Value)
 				}
 
 			case abc.KindDeco:
-				switch sym.Value {
-				case ".":
-					c.pf("-.")
-				case "!marcato!":
-					c.pf("-^")
-				case "!segno!":
-					c.pf(` \segnoMark 1 `)
-				case "!coda!":
-					c.pf(` \codaMark 1 `)
-				case "!accent!":
-					c.pf(`->`)
+				name := abc.DecorationName(sym.Value)
+				if articulation, ok := lilypondArticulations[name]; ok {
+					if approximateArticulations[name] {
+						c.warnf(tune, sym.Pos, "decoration %q is written as %s", sym.Value, articulation)
+					}
+					c.pf("%s", articulation)
+					break
+				}
+				if event, ok := lilypondEvents[name]; ok {
+					// events follow the whole note
+					tail += " " + event
+					break
+				}
+				if dynamic, ok := lilypondDynamics[name]; ok {
+					c.pf("%s", dynamic)
+					break
+				}
+				if dir := abc.HairpinStart(name); dir != "" {
+					c.pf(`\%s`, dir)
+					hairpin = true
+					break
+				}
+				if abc.IsHairpinEnd(name) {
+					// the parser has already warned about unpaired ends
+					if hairpin {
+						c.pf(`\!`)
+						hairpin = false
+					}
+					break
+				}
+				if segnoRepeat && isNavigation(name) {
+					break
+				}
+				if text, ok := lilypondJumps[name]; ok {
+					tail += fmt.Sprintf(" \\jump %q", text)
+					break
+				}
+				switch name {
+				case "segno":
+					segnoCount++
+					c.pf(" \\segnoMark %d", segnoCount)
+				case "coda":
+					codaCount++
+					c.pf(" \\codaMark %d", codaCount)
+				case "fine":
+					tail += " \\fine"
+				case "editorial", "courtesy", "invisible":
+					// IGNORE
 				default:
-					panic("unhandled deco " + sym.Value + " tune:" + tune.ID)
+					if abc.IsDecoration(name) {
+						return music, errorf(tune, sym.Pos, "unhandled deco %q", sym.Value)
+					}
+					// the parser has already warned about unknown decorations
 				}
 
 			case abc.KindField:
 				switch sym.Tag {
 				case abc.FieldRemark.Tag, abc.FieldNotes.Tag:
 					// IGNORE
+				case abc.FieldMeter.Tag:
+					meter, err := abc.ParseMeter(sym.Value)
+					if err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
+					}
+					c.pf("%s", timeSig.change(meter))
+					timing.SetMeter(meter)
+					noteLength = timing.UnitNoteLength
+				case abc.FieldParts.Tag:
+					// rehearsal marks apply to the whole score
+					if voice == voices(tune)[0] {
+						c.pf(" \\mark %q", sym.Value)
+					}
+				case abc.FieldTempo.Tag:
+					if err := c.tempo(tune, sym.Pos, sym.Value, noteLength); err != nil {
+						return music, err
+					}
 				case abc.FieldUnitNoteLength.Tag:
-					noteLength = abc.ParseNoteLength(sym.Value)
+					length, err := abc.ParseNoteLength(sym.Value)
+					if err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
+					}
+					timing.SetUnitNoteLength(length)
+					noteLength = timing.UnitNoteLength
 				case abc.FieldKey.Tag:
-					var key string
-					key, keySignature, octaveOffset = parseKeySignature(sym.Value, octaveOffset)
-					barAccidentals = maps.Clone(keySignature)
-
-					decl, ok := abcKeySignatureToLilypond[key]
-					if !ok {
-						panic("unhandled signature " + key)
+					key, err := abc.ParseKey(sym.Value)
+					if err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
 					}
-					c.pf(" %s", decl)
+					if key.HasSignature() {
+						keySignature = keyAccidentals(key)
+						barAccidentals = maps.Clone(keySignature)
+						c.pf(" %s", keyToLilypond(key))
+					}
+					if err := changeClef(key.Clef); err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
+					}
+				case abc.FieldVoice.Tag:
+					// voice redefinition in the middle of the music
+					next, err := abc.ParseVoiceClef(sym.Value)
+					if err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
+					}
+					if err := changeClef(next); err != nil {
+						return music, errorf(tune, sym.Pos, "%w", err)
+					}
+				case abc.FieldInstruction.Tag, abc.FieldUserDefined.Tag, abc.FieldMacro.Tag, abc.FieldSymbolLine.Tag:
+					// valid ABC, but not supported by the conversion
+					c.warnf(tune, sym.Pos, "ignored field %s:%s", sym.Tag, sym.Value)
 				default:
-					panic("unhandled field " + sym.Tag + ":" + sym.Value + " tune:" + tune.ID)
+					if def, ok := abc.FieldDefByTag(sym.Tag); ok && def.Type == abc.FieldTypeString {
+						// informational fields are not part of the music
+						break
+					}
+					return music, errorf(tune, sym.Pos, "unhandled field %s:%s", sym.Tag, sym.Value)
 				}
 			default:
-				panic("unhandled " + sym.Kind.String() + " tune:" + tune.ID)
+				return music, errorf(tune, sym.Pos, "unhandled %v", sym.Kind)
 			}
+		}
+		flushTail()
+		closeTuplet(false)
+		music.pieces = append(music.pieces, notePieces)
+	}
+	closeTuplet(true)
+	if hairpin {
+		c.pf(` <>\!`)
+	}
+	c.pf("%s", repeatBars[abc.SymbolRef{Stave: len(voice.Staves)}])
+	c.pf("\n")
+	return music, nil
+}
 
-			if sym.Kind == abc.KindNote || sym.Kind == abc.KindRest {
-				lastSym = sym
-			} else if sym.Kind == abc.KindBar {
-				lastSym = abc.Symbol{}
+// repeatCommands returns the LilyPond repeat commands that replace the bars.
+func repeatCommands(repeats []abc.Repeat) map[abc.SymbolRef]string {
+	bars := map[abc.SymbolRef]string{}
+	for _, repeat := range repeats {
+		bars[repeat.Start] += fmt.Sprintf(" \\repeat volta %d {", repeat.Times)
+		bars[repeat.End] += " }"
+		if len(repeat.Endings) == 0 {
+			continue
+		}
+
+		bars[repeat.End] += " \\alternative {"
+		for i, ending := range repeat.Endings {
+			if repeat.Consecutive() {
+				bars[ending.Start] += " {"
+			} else {
+				bars[ending.Start] += fmt.Sprintf(" \\volta %s {", ending.VoltaString())
+			}
+			bars[ending.End] += " }"
+			if i == len(repeat.Endings)-1 {
+				bars[ending.End] += " }"
 			}
 		}
 	}
-	c.pf("\n")
+	return bars
 }
 
-func calculateDuration(noteLength *big.Rat, sym, lastNote *abc.Symbol) big.Rat {
-	dur := *noteLength
-	dur.Mul(&dur, &sym.Duration)
+// segnoCommands returns the \repeat segno commands that replace the bars,
+// when the navigation forms a single D.C. or D.S. section that does not
+// overlap with other repeats.
+func segnoCommands(voice *abc.Voice, nav abc.Navigation) (map[abc.SymbolRef]string, bool) {
+	if len(nav.Jumps) != 1 {
+		return nil, false
+	}
+	jump := nav.Jumps[0]
 
-	for range iter(sym.Syncopation) {
-		dur.Mul(&dur, big.NewRat(3, 2))
+	start, ok := markStart(voice, jump.Target)
+	if !ok {
+		return nil, false
 	}
-	for range iter(-lastNote.Syncopation) {
-		dur.Mul(&dur, big.NewRat(3, 2))
+	end := voice.NextBar(jump.Ref)
+
+	bars := map[abc.SymbolRef]string{}
+	bars[start] = " \\repeat segno 2 {"
+	switch jump.Until {
+	case "coda":
+		if len(nav.ToCodas) != 1 || len(nav.Segnos) > 1 {
+			return nil, false
+		}
+		toCoda := voice.NextBar(nav.ToCodas[0])
+		if !start.Before(toCoda) || !toCoda.Before(end) {
+			return nil, false
+		}
+		if codaStart, ok := markStart(voice, *nav.Coda); !ok || codaStart != end {
+			return nil, false
+		}
+		bars[toCoda] = " \\alternative { \\volta 1 {"
+		bars[end] = ` } \volta 2 \volta #'() { \section \sectionLabel "Coda" } } }`
+	case "fine":
+		if len(nav.Fines) != 1 || len(nav.Segnos) > 1 {
+			return nil, false
+		}
+		fine := voice.NextBar(nav.Fines[0])
+		if !start.Before(fine) || !fine.Before(end) || !endsVoice(voice, end) {
+			return nil, false
+		}
+		bars[fine] = " \\volta 2 \\fine"
+		bars[end] = " }"
+	default:
+		if len(nav.Segnos) > 1 || nav.Coda != nil || !endsVoice(voice, end) {
+			return nil, false
+		}
+		bars[end] = " }"
 	}
-	for range iter(-sym.Syncopation) {
-		dur.Mul(&dur, big.NewRat(1, 2))
+	return bars, true
+}
+
+// markStart returns the bar before the mark, when the mark starts a measure.
+func markStart(voice *abc.Voice, mark abc.SymbolRef) (abc.SymbolRef, bool) {
+	if mark.Symbol < 0 {
+		return mark, true
 	}
-	for range iter(lastNote.Syncopation) {
-		dur.Mul(&dur, big.NewRat(1, 2))
+	symbols := voice.Staves[mark.Stave].Symbols
+	for i := mark.Symbol - 1; i >= 0; i-- {
+		switch symbols[i].Kind {
+		case abc.KindBar:
+			return abc.SymbolRef{Stave: mark.Stave, Symbol: i}, true
+		case abc.KindDeco, abc.KindText, abc.KindField:
+		default:
+			return abc.SymbolRef{}, false
+		}
 	}
+	return abc.SymbolRef{Stave: mark.Stave, Symbol: -1}, true
+}
 
-	return dur
+// endsVoice returns whether there is no music after the bar.
+func endsVoice(voice *abc.Voice, bar abc.SymbolRef) bool {
+	for stavei := bar.Stave; stavei < len(voice.Staves); stavei++ {
+		symbols := voice.Staves[stavei].Symbols
+		symi := 0
+		if stavei == bar.Stave {
+			symi = bar.Symbol + 1
+		}
+		for ; symi < len(symbols); symi++ {
+			switch symbols[symi].Kind {
+			case abc.KindNote, abc.KindRest, abc.KindBar:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isNavigation returns whether the decoration is a navigation mark.
+func isNavigation(name string) bool {
+	_, jump := lilypondJumps[name]
+	return jump || name == "segno" || name == "coda" || name == "fine"
+}
+
+// annotationToString converts annotation to a LilyPond text script.
+//
+// LilyPond places text scripts above or below the note, so annotations
+// left and right of the note are approximated by aligning the text above
+// to end at or to start after the note.
+func annotationToString(ann *abc.Annotation) string {
+	switch ann.Placement {
+	case abc.PlaceBelow:
+		return fmt.Sprintf("_%q", ann.Text)
+	case abc.PlaceLeft:
+		return fmt.Sprintf("-\\tweak self-alignment-X #RIGHT ^%q", ann.Text)
+	case abc.PlaceRight:
+		return fmt.Sprintf("-\\tweak X-offset #1.5 ^%q", ann.Text)
+	case abc.PlaceFree:
+		// ABC offsets are in points, staff space is 5pt by default
+		return fmt.Sprintf("-\\tweak extra-offset #'(%s . %s) ^%q",
+			formatFloat(ann.X/5), formatFloat(ann.Y/5), ann.Text)
+	default:
+		return fmt.Sprintf("^%q", ann.Text)
+	}
 }
 
-func parseKeySignature(keysig string, octaveOffset int) (key string, accidentals map[string]string, octave int) {
-	// TODO: allow only changing octave etc.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
 
-	if keysig == "" {
-		return "", map[string]string{}, octaveOffset
+// isPostfix returns whether the symbol is written after the note in LilyPond.
+func isPostfix(sym abc.Symbol) bool {
+	if sym.Kind == abc.KindDeco {
+		// marks are written before the note
+		name := abc.DecorationName(sym.Value)
+		return name != "segno" && name != "coda"
 	}
-	accidentals = map[string]string{}
+	return sym.Kind == abc.KindText || sym.Kind == abc.KindSlurStart
+}
 
-	fields := strings.Fields(keysig)
-	if len(fields) > 0 {
-		accidentals = lookupAccidentalMap(fields[0])
-		key = strings.ToLower(fields[0])
+// startsDottedSlur checks whether the postfixes of a note start a dotted slur.
+func startsDottedSlur(postfix []abc.Symbol) bool {
+	for _, sym := range postfix {
+		if !isPostfix(sym) {
+			return false
+		}
+		if sym.Kind == abc.KindSlurStart && sym.Dotted {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, f := range fields[1:] {
-		if strings.HasPrefix(f, "octave=") {
-			octs := strings.TrimPrefix(f, "octave=")
-			n, err := strconv.Atoi(octs)
-			if err != nil {
-				panic(err) // TODO: proper handling
+// pitchToString converts notes to a LilyPond pitch or chord,
+// it also returns the accidentals that apply to the rest of the bar.
+func pitchToString(notes []abc.Note, barAccidentals map[string]string, octaveOffset int) (string, map[string]string) {
+	var pitches []string
+	nextAccidentals := map[string]string{}
+	for _, note := range notes {
+		n := note.Pitch
+		if note.Accidentals != "" {
+			suffix := ""
+			for _, acc := range note.Accidentals {
+				switch acc {
+				case abc.AccidentalFlat:
+					suffix += "es"
+				case abc.AccidentalSharp:
+					suffix += "is"
+				case abc.AccidentalNatural:
+					suffix = ""
+				}
+			}
+			n += suffix
+			nextAccidentals[note.PitchOctave()] = suffix
+		} else {
+			if localSuffix, ok := barAccidentals[note.PitchOctave()]; ok {
+				n += localSuffix
+			} else if keySuffix, ok := barAccidentals[note.Pitch]; ok {
+				n += keySuffix
 			}
-			octaveOffset = n + 1
-		}
-	}
-
-	return key, accidentals, octaveOffset
-}
-
-var abcKeySignatureToLilypond = map[string]string{
-	"c#": `\key cis \major`,
-	"f#": `\key fis \major`,
-	"b":  `\key b \major`,
-	"e":  `\key e \major`,
-	"a":  `\key a \major`,
-	"d":  `\key d \major`,
-	"g":  `\key g \major`,
-	"c":  `\key c \major`,
-	"f":  `\key f \major`,
-	"bb": `\key bes \major`,
-	"eb": `\key ees \major`,
-	"ab": `\key aes \major`,
-	"db": `\key des \major`,
-	"gb": `\key ges \major`,
-	"cb": `\key ces \major`,
-
-	"a#m": `\key ais \minor`,
-	"d#m": `\key dis \minor`,
-	"g#m": `\key gis \minor`,
-	"c#m": `\key cis \minor`,
-	"f#m": `\key fis \minor`,
-	"bm":  `\key b \minor`,
-	"em":  `\key e \minor`,
-	"am":  `\key a \minor`,
-	"dm":  `\key d \minor`,
-	"gm":  `\key g \minor`,
-	"cm":  `\key c \minor`,
-	"fm":  `\key f \minor`,
-	"bbm": `\key bes \minor`,
-	"ebm": `\key ees \minor`,
-	"abm": `\key aes \minor`,
-}
-
-func lookupAccidentalMap(k string) map[string]string {
-	const sh = "fcgdaeb"
-	const fl = "beadgcf"
-	// F♯, C♯, G♯, D♯, A♯, E♯, B♯
-	// B♭, E♭, A♭, D♭, G♭, C♭, F♭
-
-	switch strings.ToLower(k) {
-	case "c#", "a#m", "g#mix", "d#dor", "e#phr", "f#lyd", "b#loc":
-		return makeAccidentalMap(sh[:7], "is")
-	case "f#", "d#m", "c#mix", "g#dor", "a#phr", "blyd", "e#loc":
-		return makeAccidentalMap(sh[:6], "is")
-	case "b", "g#m", "f#mix", "c#dor", "d#phr", "elyd", "a#loc":
-		return makeAccidentalMap(sh[:5], "is")
-	case "e", "c#m", "bmix", "f#dor", "g#phr", "alyd", "d#loc":
-		return makeAccidentalMap(sh[:4], "is")
-	case "a", "f#m", "emix", "bdor", "c#phr", "dlyd", "g#loc":
-		return makeAccidentalMap(sh[:3], "is")
-	case "d", "bm", "amix", "edor", "f#phr", "glyd", "c#loc":
-		return makeAccidentalMap(sh[:2], "is")
-	case "g", "em", "dmix", "ador", "bphr", "clyd", "f#loc":
-		return makeAccidentalMap(sh[:1], "is")
-	case "c", "am", "gmix", "ddor", "ephr", "flyd", "bloc":
-		return map[string]string{}
-	case "f", "dm", "cmix", "gdor", "aphr", "bblyd", "eloc":
-		return makeAccidentalMap(fl[:1], "es")
-	case "bb", "gm", "fmix", "cdor", "dphr", "eblyd", "aloc":
-		return makeAccidentalMap(fl[:2], "es")
-	case "eb", "cm", "bbmix", "fdor", "gphr", "ablyd", "dloc":
-		return makeAccidentalMap(fl[:3], "es")
-	case "ab", "fm", "ebmix", "bbdor", "cphr", "dblyd", "gloc":
-		return makeAccidentalMap(fl[:4], "es")
-	case "db", "bbm", "abmix", "ebdor", "fphr", "gblyd", "cloc":
-		return makeAccidentalMap(fl[:5], "es")
-	case "gb", "ebm", "dbmix", "abdor", "bbphr", "cblyd", "floc":
-		return makeAccidentalMap(fl[:6], "es")
-	case "cb", "abm", "gbmix", "dbdor", "ebphr", "fblyd", "bbloc":
-		return makeAccidentalMap(fl[:7], "es")
+		}
+
+		oct := note.Octave + octaveOffset
+		for range iter(oct) {
+			n += "'"
+		}
+		for range iter(-oct) {
+			n += ","
+		}
+
+		pitches = append(pitches, n)
+	}
+
+	switch {
+	case len(pitches) > 1:
+		return "<" + strings.Join(pitches, " ") + ">", nextAccidentals
+	case len(pitches) == 1:
+		return pitches[0], nextAccidentals
 	default:
-		panic("unknown key " + k)
+		return "", nextAccidentals
 	}
 }
 
-func makeAccidentalMap(k string, sig string) map[string]string {
-	acc := make(map[string]string)
-	for _, r := range k {
-		acc[string(r)] += sig
+// grace writes grace notes, the accidentals inside the group
+// do not affect the rest of the bar.
+func (c *Convert) grace(grace *abc.Grace, noteLength *big.Rat, barAccidentals map[string]string, octaveOffset int) {
+	command := "grace"
+	switch {
+	case grace.Acciaccatura:
+		command = "acciaccatura"
+	case c.Appoggiatura:
+		command = "appoggiatura"
+	}
+
+	// the standard leaves grace note length unspecified,
+	// use eighths for single grace notes and sixteenths otherwise
+	unit := big.NewRat(1, 16)
+	if len(grace.Notes) == 1 {
+		unit = big.NewRat(1, 8)
 	}
-	return acc
+
+	accidentals := maps.Clone(barAccidentals)
+	c.pf(" \\%s {", command)
+	for _, sym := range grace.Notes {
+		pitch, next := pitchToString(sym.Notes, accidentals, octaveOffset)
+		for k, v := range next {
+			accidentals[k] = v
+		}
+		dur := *unit
+		dur.Mul(&dur, &sym.Duration)
+		c.pf(" %s%s", pitch, scaledDuration(dur))
+	}
+	c.pf(" }")
+}
+
+// timeSignature tracks the time signature of a staff.
+type timeSignature struct {
+	meter   abc.Meter
+	numeric bool
+}
+
+// change returns the LilyPond commands for changing the meter to next.
+func (ts *timeSignature) change(next abc.Meter) string {
+	var s string
+	if ts.meter.Free && !next.Free {
+		s += ` \cadenzaOff`
+	}
+
+	switch {
+	case next.Free:
+		if !ts.meter.Free {
+			s += ` \cadenzaOn`
+		}
+	case len(next.Groups) > 0:
+		groups := ""
+		for _, n := range next.Groups {
+			groups += fmt.Sprintf("%d ", n)
+		}
+		s += fmt.Sprintf(" \\compoundMeter #'((%s%d))", groups, next.BeatLength)
+	default:
+		// LilyPond uses C and C| symbols for 4/4 and 2/2 by default
+		common := next.BeatsPerMeasure == next.BeatLength && (next.BeatLength == 4 || next.BeatLength == 2)
+		if common && next.Symbol == "" && !ts.numeric {
+			s += ` \numericTimeSignature`
+			ts.numeric = true
+		}
+		if next.Symbol != "" && ts.numeric {
+			s += ` \defaultTimeSignature`
+			ts.numeric = false
+		}
+		s += fmt.Sprintf(" \\time %d/%d", next.BeatsPerMeasure, next.BeatLength)
+	}
+
+	ts.meter = next
+	return s
+}
+
+// keyToLilypond converts key to a LilyPond key signature.
+func keyToLilypond(key abc.Key) string {
+	if key.None {
+		return `\key c \major`
+	}
+	if !key.Explicit && len(key.Accidentals) == 0 {
+		return `\key ` + pitchName(key.Tonic) + ` \` + key.Mode
+	}
+
+	// custom key signatures list sharps and flats in their usual order
+	acc := key.AccidentalMap()
+	var alterations []string
+	for _, pitch := range "fcgdaeb" {
+		if n := acc[string(pitch)]; n > 0 {
+			alterations = append(alterations, fmt.Sprintf("(%d . ,%s)", pitchStep(string(pitch)), alterationNames[n]))
+		}
+	}
+	for _, pitch := range "beadgcf" {
+		if n := acc[string(pitch)]; n < 0 {
+			alterations = append(alterations, fmt.Sprintf("(%d . ,%s)", pitchStep(string(pitch)), alterationNames[n]))
+		}
+	}
+	return "\\set Staff.keyAlterations = #`(" + strings.Join(alterations, " ") + ")"
+}
+
+var alterationNames = map[int]string{
+	-2: "DOUBLE-FLAT",
+	-1: "FLAT",
+	1:  "SHARP",
+	2:  "DOUBLE-SHARP",
+}
+
+// pitchName converts a tonic such as "F#" or "Bb" to LilyPond pitch name.
+func pitchName(tonic string) string {
+	name := strings.ToLower(tonic[:1])
+	switch tonic[1:] {
+	case "#":
+		name += "is"
+	case "b":
+		name += "es"
+	}
+	return name
+}
+
+// pitchStep returns the step of the pitch counting from c.
+func pitchStep(pitch string) int {
+	return strings.Index("cdefgab", pitch)
+}
+
+// keyAccidentals returns the LilyPond accidental suffix for the pitches in the key.
+func keyAccidentals(key abc.Key) map[string]string {
+	accidentals := map[string]string{}
+	for pitch, n := range key.AccidentalMap() {
+		suffix := ""
+		for range iter(n) {
+			suffix += "is"
+		}
+		for range iter(-n) {
+			suffix += "es"
+		}
+		accidentals[pitch] = suffix
+	}
+	return accidentals
+}
+
+// clef writes the clef and transposition specified in clef.
+func (c *Convert) clef(clef abc.Clef) error {
+	switch clef.Name {
+	case "":
+	case "none":
+		c.pf(" \\omit Staff.Clef")
+	case "perc":
+		c.pf(" \\clef percussion")
+	default:
+		sign, line := clef.Sign()
+		name, ok := lilypondClefs[fmt.Sprintf("%c%d", sign, line)]
+		if !ok {
+			return fmt.Errorf("unsupported clef %s%d", clef.Name, line)
+		}
+		switch clef.Ottava {
+		case 1:
+			name = `"` + name + `^8"`
+		case -1:
+			name = `"` + name + `_8"`
+		}
+		c.pf(" \\clef %s", name)
+	}
+
+	if clef.HasTranspose {
+		c.pf(" \\transposition %s", semitonesToPitch(clef.Transpose))
+	}
+	return nil
+}
+
+// lilypondClefs maps clef sign and line to LilyPond clef name.
+var lilypondClefs = map[string]string{
+	"G1": "french",
+	"G2": "treble",
+	"F3": "varbaritone",
+	"F4": "bass",
+	"F5": "subbass",
+	"C1": "soprano",
+	"C2": "mezzosoprano",
+	"C3": "alto",
+	"C4": "tenor",
+	"C5": "baritone",
+}
+
+// clefOctaveOffset returns the LilyPond octave of abc notes without octave marks.
+func clefOctaveOffset(clef abc.Clef) (int, error) {
+	shift, err := clef.OctaveShift()
+	return 1 + shift, err
+}
+
+// semitonesToPitch returns the pitch n semitones from middle c.
+func semitonesToPitch(n int) string {
+	names := []string{"c", "cis", "d", "ees", "e", "f", "fis", "g", "aes", "a", "bes", "b"}
+	octave := 1
+	for n < 0 {
+		n += 12
+		octave--
+	}
+	octave += n / 12
+
+	pitch := names[n%12]
+	for range iter(octave) {
+		pitch += "'"
+	}
+	for range iter(-octave) {
+		pitch += ","
+	}
+	return pitch
 }
 
 func iter(n int) []struct{} {
@@ -523,18 +1441,80 @@ func iter(n int) []struct{} {
 	return nil
 }
 
-func durationToString(dur big.Rat) string {
-	num := dur.Num().Int64()
-	denom := dur.Denom().Int64()
+// measureDuration returns the duration of n measures, e.g. "2.*4".
+func measureDuration(measure big.Rat, n int) string {
+	s := scaledDuration(measure)
+	if n != 1 {
+		s += "*" + strconv.Itoa(n)
+	}
+	return s
+}
+
+// tempo writes the tempo mark of `Q:` value, a tempo that can't be
+// written as a metronome mark is written as markup.
+func (c *Convert) tempo(tune *abc.Tune, pos abc.Pos, value string, unitNoteLength big.Rat) error {
+	tempo, err := abc.ParseTempo(value)
+	if err != nil {
+		return errorf(tune, pos, "%w", err)
+	}
+	mark, err := tempoToLilypond(tempo, unitNoteLength)
+	if err != nil {
+		c.warnf(tune, pos, "%v, writing it as markup", err)
+		mark = tempoToMarkup(tempo, unitNoteLength)
+	}
+	c.pf(" %s", mark)
+	return nil
+}
+
+// tempoToLilypond converts tempo to a LilyPond \tempo mark.
+func tempoToLilypond(tempo abc.Tempo, unitNoteLength big.Rat) (string, error) {
+	mark := `\tempo`
+	if tempo.Text != "" {
+		mark += " " + strconv.Quote(tempo.Text)
+	}
+	if tempo.BPM > 0 {
+		beat := tempo.Beat(unitNoteLength)
+		if !isWritable(beat) {
+			return "", fmt.Errorf("unsupported tempo beat %v", beat.RatString())
+		}
+		dur, err := durationToString(beat)
+		if err != nil {
+			return "", err
+		}
+		mark += fmt.Sprintf(" %s = %d", dur, tempo.BPM)
+	}
+	return mark, nil
+}
 
-	if num == 1 {
-		return strconv.Itoa(int(denom))
+// tempoToMarkup converts tempo to a \tempo mark that lists
+// the beats, e.g. `\note {4} #UP " " \note {4.} #UP " = 40"`,
+// followed by the tempo in whole notes per minute.
+func tempoToMarkup(tempo abc.Tempo, unitNoteLength big.Rat) string {
+	beats := tempo.Beats
+	if tempo.Relative || len(beats) == 0 {
+		beats = []big.Rat{unitNoteLength}
 	}
-	if num == 3 {
-		return strconv.Itoa(int(denom/2)) + "."
+
+	var notes []string
+	for _, beat := range beats {
+		if dur, err := durationToString(beat); err == nil && isWritable(beat) {
+			notes = append(notes, fmt.Sprintf(`\note {%s} #UP`, dur))
+		} else {
+			notes = append(notes, strconv.Quote(beat.RatString()))
+		}
 	}
 
-	panic("unhandled duration " + dur.RatString())
+	mark := `\tempo \markup {`
+	if tempo.Text != "" {
+		mark += " " + strconv.Quote(tempo.Text)
+	}
+	mark += fmt.Sprintf(` \concat { %s " = %d" } }`, strings.Join(notes, ` " " `), tempo.BPM)
+
+	// markup does not set the tempo, which is needed for MIDI
+	wholes := tempo.Beat(unitNoteLength)
+	wholes.Mul(&wholes, big.NewRat(int64(tempo.BPM), 1))
+	mark += fmt.Sprintf(` \set Score.tempoWholesPerMinute = #(ly:make-moment %s)`, wholes.RatString())
+	return mark
 }
 
 func (c *Convert) Header(tune *abc.Tune) {
@@ -542,18 +1522,99 @@ func (c *Convert) Header(tune *abc.Tune) {
 	defer c.pf("  }\n")
 
 	c.pf("      piece = %q\n", tune.Title)
-	for _, field := range tune.Fields {
+	for _, field := range tune.AllFields() {
 		switch field.Tag {
 		case abc.FieldComposer.Tag:
 			c.pf("      composer = %q\n", field.Value)
 		case abc.FieldHistory.Tag:
 			c.pf("      history = %q\n", field.Value)
-		case abc.FieldTempo.Tag:
-			value := field.Value
-			if unquoted, err := strconv.Unquote(value); err == nil {
-				value = unquoted
-			}
-			c.pf("      meter = %q\n", value)
 		}
 	}
 }
+
+// lilypondArticulations maps decoration names to LilyPond post-events.
+var lilypondArticulations = map[string]string{
+	"staccato":        "-.",
+	"tenuto":          "--",
+	"wedge":           "-!",
+	">":               "->",
+	"accent":          "->",
+	"emphasis":        "->",
+	"^":               "-^",
+	"marcato":         "-^",
+	"+":               "-+",
+	"plus":            "-+",
+	"0":               "-0",
+	"1":               "-1",
+	"2":               "-2",
+	"3":               "-3",
+	"4":               "-4",
+	"5":               "-5",
+	"trill":           `\trill`,
+	"trill(":          `\startTrillSpan`,
+	"trill)":          `\stopTrillSpan`,
+	"lowermordent":    `\mordent`,
+	"mordent":         `\mordent`,
+	"uppermordent":    `\prall`,
+	"pralltriller":    `\prall`,
+	"roll":            `\turn`,
+	"turn":            `\turn`,
+	"turnx":           `\slashturn`,
+	"invertedturn":    `\reverseturn`,
+	"invertedturnx":   `\reverseturn`,
+	"arpeggio":        `\arpeggio`,
+	"fermata":         `\fermata`,
+	"invertedfermata": `_\fermata`,
+	"upbow":           `\upbow`,
+	"downbow":         `\downbow`,
+	"open":            `\open`,
+	"thumb":           `\thumb`,
+	"snap":            `\snappizzicato`,
+	"slide":           `\bendAfter #-4`,
+	"ped":             `\sustainOn`,
+	"ped-up":          `\sustainOff`,
+}
+
+// approximateArticulations contains the decorations that LilyPond has
+// no equivalent for: slide is a scoop into the note, but \bendAfter draws
+// a fall after it, and there is no slashed reverse turn.
+var approximateArticulations = map[string]bool{
+	"slide":         true,
+	"invertedturnx": true,
+}
+
+// lilypondEvents maps decoration names to LilyPond events that are
+// written after the note.
+var lilypondEvents = map[string]string{
+	"breath":       `\breathe`,
+	"shortphrase":  `\bar "'"`,
+	"mediumphrase": `\bar ","`,
+	"longphrase":   `\bar "!"`,
+}
+
+// lilypondDynamics maps dynamic decorations to LilyPond dynamics.
+var lilypondDynamics = map[string]string{
+	"pppp": `\pppp`,
+	"ppp":  `\ppp`,
+	"pp":   `\pp`,
+	"p":    `\p`,
+	"mp":   `\mp`,
+	"mf":   `\mf`,
+	"f":    `\f`,
+	"ff":   `\ff`,
+	"fff":  `\fff`,
+	"ffff": `\ffff`,
+	"sfz":  `\sfz`,
+}
+
+// lilypondJumps maps jump decorations to LilyPond jump texts.
+var lilypondJumps = map[string]string{
+	"D.C.":       "D.C.",
+	"D.S.":       "D.S.",
+	"dacapo":     "Da Capo",
+	"dacoda":     "Da Coda",
+	"D.C.alfine": "D.C. al Fine",
+	"D.C.alcoda": "D.C. al Coda",
+	"D.S.alfine": "D.S. al Fine",
+	"D.S.alcoda": "D.S. al Coda",
+}
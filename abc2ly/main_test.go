@@ -3,8 +3,11 @@ package main
 import (
 	"bytes"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
@@ -40,9 +43,13 @@ func TestConvert(t *testing.T) {
 			fmt.Fprintln(&out, `\header { tagline = #f }`)
 			fmt.Fprintln(&out)
 
-			convert := &Convert{Output: &out}
+			convert := &Convert{Output: &out, Warn: func(err error) { t.Log(err) }}
+			// unfold*.abc are written in the playing order of the parts
+			convert.UnfoldParts = strings.HasPrefix(filepath.Base(abcpath), "unfold")
 			for _, tune := range book.Tunes {
-				convert.Tune(tune)
+				if err := convert.Tune(tune); err != nil {
+					t.Error(err)
+				}
 			}
 
 			converted := out.String()
@@ -67,3 +74,81 @@ func TestConvert(t *testing.T) {
 	}
 
 }
+
+func TestConvertError(t *testing.T) {
+	book, _ := abc.Parse("X: 1\nT: Good\nK: C\nabc |]\n\nX: 237\nT: Bad\nM: none\nK: C\nab Z |]\n")
+
+	var out bytes.Buffer
+	convert := &Convert{Output: &out}
+	if err := convert.Tune(book.Tunes[0]); err != nil {
+		t.Fatal(err)
+	}
+	good := out.Len()
+
+	err := convert.Tune(book.Tunes[1])
+	var convErr *Error
+	if !errors.As(err, &convErr) {
+		t.Fatalf("expected conversion error, got %v", err)
+	}
+	if convErr.TuneID != "237" || convErr.Pos != (abc.Pos{Line: 10, Column: 4}) {
+		t.Errorf("invalid error %v", convErr)
+	}
+	if out.Len() != good {
+		t.Errorf("failed tune was written to output")
+	}
+}
+
+func TestConvertWarning(t *testing.T) {
+	book, _ := abc.Parse("X: 1\nK: C\n\"<(1)\"c \">(2)\"d \"^(3)\"e |\nI:linebreak $\nc d !D.S.!e !slide!f |]\n")
+
+	var warnings []error
+	convert := &Convert{Output: io.Discard, Warn: func(err error) { warnings = append(warnings, err) }}
+	if err := convert.Tune(book.Tunes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 5 {
+		t.Fatalf("expected 5 warnings, got %v", warnings)
+	}
+	if got := warnings[0].Error(); got != `5:5: tune "1": D.S. without a segno` {
+		t.Errorf("invalid warning %v", got)
+	}
+	if got := warnings[1].Error(); got != `3:1: tune "1": annotation "(1)" is placed above the note` {
+		t.Errorf("invalid warning %v", got)
+	}
+	if got := warnings[3].Error(); got != `4:1: tune "1": ignored field I:linebreak $` {
+		t.Errorf("invalid warning %v", got)
+	}
+	if got := warnings[4].Error(); got != `5:13: tune "1": decoration "!slide!" is written as \bendAfter #-4` {
+		t.Errorf("invalid warning %v", got)
+	}
+}
+
+func TestSplitDuration(t *testing.T) {
+	tests := []struct {
+		meter  string
+		offset *big.Rat
+		dur    *big.Rat
+		expect string
+	}{
+		{"4/4", big.NewRat(0, 1), big.NewRat(5, 8), "2 8"},
+		{"4/4", big.NewRat(1, 8), big.NewRat(5, 8), "8 2"},
+		{"4/4", big.NewRat(0, 1), big.NewRat(7, 8), "2.."},
+		{"4/4", big.NewRat(1, 2), big.NewRat(3, 4), "2 4"},
+		{"6/8", big.NewRat(0, 1), big.NewRat(5, 8), "4. 4"},
+		{"3/4", big.NewRat(1, 4), big.NewRat(1, 2), "2"},
+		{"none", big.NewRat(0, 1), big.NewRat(9, 8), "1 8"},
+	}
+	for _, test := range tests {
+		meter, err := abc.ParseMeter(test.meter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pieces []string
+		for _, piece := range splitDuration(*test.dur, *test.offset, meter) {
+			pieces = append(pieces, scaledDuration(piece))
+		}
+		if got := strings.Join(pieces, " "); got != test.expect {
+			t.Errorf("%v at %v in %v: expected %q, got %q", test.dur, test.offset, test.meter, test.expect, got)
+		}
+	}
+}